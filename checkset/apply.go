@@ -3,52 +3,228 @@
 package checkset
 
 import (
-	"../futility"
+	"context"
 	"errors"
+	"github.com/rspeele/check-update/futility"
 	"io"
 	"os"
 	"path"
 )
 
 // function which returns an open stream for reading a file, when
-// given its remote relative path.
-type Retriever func(string) (io.ReadCloser, error)
+// given its remote relative path. should give up when ctx is done.
+type Retriever func(ctx context.Context, name string) (io.ReadCloser, error)
 
-var ExistingSpecial = errors.New("don't want to replace a not-file with a file")
+// like Retriever, but for length bytes of the file starting at offset.
+// returns NoRanges if only whole files can be retrieved.
+type RangeRetriever func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
 
-func Resolve(root string, bad BadFile, get Retriever) error {
+// where to get files from. Range is optional. if ByHash is set, files
+// are retrieved by their ObjectPath rather than their own path. if
+// Store is set, files are installed from it, and fetched into it first
+// if need be.
+type Source struct {
+	Get Retriever
+	Range RangeRetriever
+	ByHash bool
+	Store Store
+}
+
+// remote path of the file described by info and found at name in the release
+func (src Source) RemotePath(name string, info CheckInfo) string {
+	if src.ByHash {
+		return ObjectPath(info.Hash)
+	}
+	return name
+}
+
+var ExistingSpecial = errors.New("don't want to replace a non-empty directory")
+var ThroughSymlink = errors.New("won't install through a symlinked directory")
+var NoRanges = errors.New("source can't retrieve parts of files")
+
+// download to a temporary file next to local, so that if the download
+// fails or is cancelled, local is left as it was
+func installFile(ctx context.Context, local string, info CheckInfo, remote string, get Retriever) error {
+	read, err := get(ctx, remote)
+	if err != nil {
+		return err
+	}
+	defer read.Close()
+	part := local + ".part"
+	write, err := futility.Create(part, info.Mode & permBits)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(write, read)
+	write.Close()
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+	return futility.Replace(part, local)
+}
+
+func installLink(local string, info CheckInfo) error {
+	err := os.MkdirAll(path.Dir(local), 0744)
+	if err != nil {
+		return err
+	}
+	os.Remove(local) // may be an outdated link
+	return os.Symlink(info.Link, local)
+}
+
+func installDirectory(local string, info CheckInfo) error {
+	err := os.MkdirAll(local, info.Mode & permBits)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(local, info.Mode & permBits)
+}
+
+func install(ctx context.Context, local string, info CheckInfo, remote string, src Source) error {
+	switch {
+	case info.Mode & os.ModeSymlink != 0:
+		return installLink(local, info)
+	case info.Mode.IsDir():
+		return installDirectory(local, info)
+	case src.Store != "":
+		return installStored(ctx, local, info, remote, src)
+	}
+	return installFile(ctx, local, info, remote, src.Get)
+}
+
+// a symlink in place of one of the directories name is in could lead
+// anywhere, so nothing is installed under one
+func checkParents(root, name string) error {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		stat, err := os.Lstat(path.Join(root, dir))
+		if err == nil && stat.Mode() & os.ModeSymlink != 0 {
+			return ThroughSymlink
+		}
+	}
+	return nil
+}
+
+func Resolve(ctx context.Context, root string, bad BadFile, src Source) error {
+	err := checkEntry(bad.Remote, bad.Info)
+	if err == nil {
+		err = checkParents(root, bad.Remote)
+	}
+	if err != nil {
+		return err
+	}
 	// use root argument instead of bad.Local to allow updating to
 	// a different path than was checked; might be useful later
 	local := path.Join(root, bad.Remote)
+	remote := src.RemotePath(bad.Remote, bad.Info)
 	switch bad.Reason {
-	case Missing, HashMismatch:
-		read, err := get(bad.Remote)
-		if err != nil {
-			return err
+	case Missing, Unreadable:
+		return install(ctx, local, bad.Info, remote, src)
+	case HashMismatch:
+		// files from a store are linked to it, so mustn't be patched
+		// or repaired in place. installing from the store handles it.
+		if src.Store != "" {
+			return install(ctx, local, bad.Info, remote, src)
 		}
-		defer read.Close()
-		write, err := futility.Create(local, bad.Info.Mode)
-		if err != nil {
-			return err
+		// cheapest first: a patch, then the blocks that differ
+		if CanPatch(bad.Info) && Patch(ctx, local, bad.Info, src.Get) == nil {
+			return nil
 		}
-		defer write.Close()
-		_, err = io.Copy(write, read)
-		return err
+		if CanRepair(bad.Info, src) {
+			err := Repair(ctx, local, bad.Info, remote, src.Range)
+			if err == nil {
+				return nil
+			}
+			// otherwise fall back to getting the whole thing
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return install(ctx, local, bad.Info, remote, src)
 	case TypeMismatch:
-		return ExistingSpecial
+		// get whatever is there out of the way. this fails for
+		// directories with things in them, which we leave alone.
+		if os.Remove(local) != nil {
+			return ExistingSpecial
+		}
+		return install(ctx, local, bad.Info, remote, src)
 	case PermMismatch:
-		return os.Chmod(local, bad.Info.Mode)
+		return os.Chmod(local, bad.Info.Mode & permBits)
 	}
 	return nil
 }
 
-func Apply(root string, get Retriever, bads chan BadFile, errs chan error) {
-	var err error
-	for bad := range bads {
-		err = Resolve(root, bad, get)
+// what became of a bad file given to Apply. Err is nil if it was fixed.
+type Resolution struct {
+	Bad BadFile
+	Err error
+}
+
+// sends a Resolution to done for each of bads, in the same order. stops
+// once ctx is done, leaving the file it was working on as it was, with
+// ctx.Err() as its Resolution's Err.
+func Apply(ctx context.Context, root string, src Source, bads chan BadFile, done chan Resolution, tracker *Tracker) {
+	src = tracker.Source(contextSource(ctx, src))
+	defer close(done)
+	for {
+		var bad BadFile
+		var ok bool
+		select {
+		case bad, ok = <-bads:
+		case <-ctx.Done():
+			return
+		}
+		if !ok {
+			return
+		}
+		tracker.Resolving(bad)
+		err := Resolve(ctx, root, bad, src)
+		tracker.Resolved(bad)
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		done <- Resolution { bad, err }
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// stops reading once ctx is done, for retrievers that don't watch it
+type contextReader struct {
+	ctx context.Context
+	stream io.ReadCloser
+}
+
+func (read *contextReader) Read(p []byte) (int, error) {
+	if err := read.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return read.stream.Read(p)
+}
+
+func (read *contextReader) Close() error {
+	return read.stream.Close()
+}
+
+func contextSource(ctx context.Context, src Source) Source {
+	get := src.Get
+	src.Get = func(ctx context.Context, name string) (io.ReadCloser, error) {
+		stream, err := get(ctx, name)
 		if err != nil {
-			errs <- err
+			return nil, err
+		}
+		return &contextReader { ctx, stream }, nil
+	}
+	if src.Range != nil {
+		getRange := src.Range
+		src.Range = func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+			stream, err := getRange(ctx, name, offset, length)
+			if err != nil {
+				return nil, err
+			}
+			return &contextReader { ctx, stream }, nil
 		}
 	}
-	close(errs)
+	return src
 }
\ No newline at end of file
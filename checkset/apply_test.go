@@ -0,0 +1,51 @@
+package checkset
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func stringSource(files map[string]string) Source {
+	get := func(ctx context.Context, name string) (io.ReadCloser, error) {
+		content, ok := files[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(strings.NewReader(content)), nil
+	}
+	return Source { Get: get }
+}
+
+// a link to outside the tree followed by a file under it
+func TestResolveThroughSymlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "checkset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside := filepath.Join(root, "outside")
+	tree := filepath.Join(root, "tree")
+	os.Mkdir(outside, 0755)
+	os.Mkdir(tree, 0755)
+	os.Symlink(outside, filepath.Join(tree, "foo"))
+	src := stringSource(map[string]string { "foo/passwd": "owned" })
+	info := CheckInfo { AllPlatforms, 0644, HashLink("owned"), 5, "", 0, nil, nil }
+	bad := BadFile { Remote: "foo/passwd", Info: info, Reason: Missing }
+	err = Resolve(context.Background(), tree, bad, src)
+	if err != ThroughSymlink {
+		t.Errorf("got %v, want ThroughSymlink", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "passwd")); err == nil {
+		t.Error("installed outside the tree")
+	}
+	link := CheckInfo { AllPlatforms, os.ModeSymlink | 0777, HashLink("/etc"), 4, "/etc", 0, nil, nil }
+	err = Resolve(context.Background(), tree, BadFile { Remote: "etc", Info: link, Reason: Missing }, src)
+	if err != BadLink {
+		t.Errorf("got %v, want BadLink", err)
+	}
+}
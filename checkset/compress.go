@@ -0,0 +1,31 @@
+// compress.go - optional gzip container around a CheckSet
+
+package checkset
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// leading bytes of a gzip stream, which can't be confused with the
+// magic number of an uncompressed CheckSet
+var gzipMagic = []byte { 0x1f, 0x8b }
+
+// returns the uncompressed CheckSet in stream, whether or not it was
+// compressed
+func Decompress(stream io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(stream)
+	lead, err := buffered.Peek(len(gzipMagic))
+	if err == nil && bytes.Equal(lead, gzipMagic) {
+		return gzip.NewReader(buffered)
+	}
+	return buffered, nil
+}
+
+// returns a writer compressing to stream, which must be closed to
+// finish the compressed data
+func Compress(stream io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(stream, gzip.BestCompression)
+}
@@ -3,35 +3,215 @@
 package checkset
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 )
 
 type CreateInfo struct {
 	Name string
 	Mode os.FileMode
+	Size int64
 	Target Platform
+	BlockSize int64 // hash blocks of this size if nonzero
+	Path string // where the file goes in the release; its path relative to the root if empty
+	Known *CheckInfo // earlier hashes of the file, if it is known not to have changed
 }
 
-func Create(root string, files chan CreateInfo, result chan CheckSet) {
+// most block hashes that fit in an entry
+const maxBlocks = (0xffff - infoLengthPlatform) / HashSize
+
+// grow blockSize until a file of size has few enough blocks to encode.
+// 0 if the blocks would then be bigger than readers accept.
+func fitBlockSize(size int64, blockSize int64) int64 {
+	for (size + blockSize - 1) / blockSize > maxBlocks {
+		blockSize *= 2
+	}
+	if blockSize > DefaultLimits.MaxBlockSize {
+		return 0
+	}
+	return blockSize
+}
+
+// size of the blocks to hash filestat in, or 0 for none
+func blockSizeOf(filestat CreateInfo) int64 {
+	if filestat.BlockSize <= 0 {
+		return 0
+	}
+	return fitBlockSize(filestat.Size, filestat.BlockSize)
+}
+
+// whether known has the hashes filestat needs, so it needn't be hashed
+func Reusable(known CheckInfo, filestat CreateInfo) bool {
+	switch {
+	case filestat.Mode & os.ModeType != known.Mode & os.ModeType:
+		return false
+	case filestat.Mode & os.ModeSymlink != 0:
+		return true // a link is known by its target
+	case filestat.Mode & os.ModeType != 0:
+		return false // nothing to hash
+	case known.Size != filestat.Size:
+		return false
+	case filestat.BlockSize > 0:
+		return known.BlockSize == blockSizeOf(filestat)
+	}
+	return true
+}
+
+// kinds of file that can go in a CheckSet
+const createTypes = os.ModeDir | os.ModeSymlink
+
+func createCheckInfo(filestat CreateInfo) (CheckInfo, error) {
+	info := CheckInfo {
+		filestat.Target,
+		filestat.Mode,
+		[HashSize]byte{},
+		0,
+		"",
+		0,
+		nil,
+		nil,
+	}
+	var err error
+	switch {
+	case filestat.Known != nil && Reusable(*filestat.Known, filestat):
+		info.Hash = filestat.Known.Hash
+		info.Size = filestat.Known.Size
+		info.Link = filestat.Known.Link
+		if filestat.BlockSize > 0 {
+			info.BlockSize = filestat.Known.BlockSize
+			info.Blocks = filestat.Known.Blocks
+		}
+	case filestat.Mode & os.ModeSymlink != 0:
+		info.Link, err = os.Readlink(filestat.Name)
+		info.Hash = HashLink(info.Link)
+		info.Size = int64(len(info.Link))
+	case filestat.Mode.IsDir():
+	case blockSizeOf(filestat) > 0:
+		info.BlockSize = blockSizeOf(filestat)
+		info.Hash, info.Blocks, err = HashFileBlocks(filestat.Name, info.BlockSize)
+		info.Size = filestat.Size
+	default:
+		info.Hash, err = HashFile(filestat.Name)
+		info.Size = filestat.Size
+	}
+	return info, err
+}
+
+// the directories with entries in them, each with the first such entry
+func fullDirectories(cset CheckSet) map[string]string {
+	full := make(map[string]string)
+	for _, rel := range SortedNames(cset) {
+		for dir := path.Dir(rel); dir != "." && full[dir] == ""; dir = path.Dir(dir) {
+			full[dir] = rel
+		}
+	}
+	return full
+}
+
+// the entry of a file that isn't on disk, such as one in an archive,
+// to use as filestat.Known. content is read if the file is a regular
+// one; link is the target if it is a symlink.
+func CreateCheckInfo(filestat CreateInfo, content io.Reader, link string) (CheckInfo, error) {
+	info := CheckInfo {
+		filestat.Target,
+		filestat.Mode,
+		[HashSize]byte{},
+		0,
+		"",
+		0,
+		nil,
+		nil,
+	}
+	var err error
+	switch {
+	case filestat.Mode & os.ModeSymlink != 0:
+		info.Link = link
+		info.Hash = HashLink(link)
+		info.Size = int64(len(link))
+	case filestat.Mode & os.ModeType != 0:
+	case blockSizeOf(filestat) > 0:
+		info.BlockSize = blockSizeOf(filestat)
+		info.Hash, info.Blocks, err = HashReaderBlocks(content, info.BlockSize)
+		info.Size = filestat.Size
+	default:
+		info.Hash, err = HashReader(content)
+		info.Size = filestat.Size
+	}
+	return info, err
+}
+
+// directories are only listed when they are empty, since creating the
+// files in a directory creates it anyway
+func dropFullDirectories(cset CheckSet, full map[string]string) {
+	for rel, info := range cset {
+		if info.Mode.IsDir() && full[rel] != "" {
+			delete(cset, rel)
+		}
+	}
+}
+
+// sends an error to errs for each file that can't be read, or that
+// goes where another file already does, and carries on without it.
+// directories may go where other directories do. then closes errs and
+// sends the CheckSet of everything else to result.
+func Create(root string, files chan CreateInfo, result chan CheckSet, errs chan *FileError) {
 	cset := make(CheckSet)
+	from := make(map[string]string) // file each entry was made from
+	conflicts := make(map[string]bool)
 	for filestat := range files {
-		if filestat.Target.OS == 0 || filestat.Target.Arch == 0 || filestat.Mode.IsDir() {
+		if filestat.Target.OS == 0 || filestat.Target.Arch == 0 {
 			continue
 		}
-		hash, err := HashFile(filestat.Name)
-		if err != nil {
-			break
+		if filestat.Mode & os.ModeType & ^createTypes != 0 {
+			continue // devices, pipes and the like
+		}
+		rel := filestat.Path
+		if rel == "" {
+			var err error
+			rel, err = filepath.Rel(root, filestat.Name)
+			if err != nil {
+				rel = filestat.Name
+			}
+			rel = filepath.ToSlash(rel)
+		}
+		if rel == "." {
+			continue // the root itself
+		}
+		if len(rel) > DefaultLimits.MaxNameLength {
+			errs <- &FileError { rel, NameTooLong }
+			continue
+		}
+		if earlier, ok := cset[rel]; ok {
+			if !earlier.Mode.IsDir() || !filestat.Mode.IsDir() {
+				errs <- &FileError { rel, fmt.Errorf("both %s and %s go here", from[rel], filestat.Name) }
+				conflicts[rel] = true
+			}
+			continue
+		}
+		info, err := createCheckInfo(filestat)
+		if err == nil && info.Mode & os.ModeSymlink != 0 {
+			err = checkLink(rel, info.Link)
 		}
-		rel, err := filepath.Rel(root, filestat.Name)
 		if err != nil {
-			rel = filestat.Name
+			errs <- &FileError { rel, err }
+			continue
 		}
-		cset[rel] = CheckInfo {
-			filestat.Target,
-			filestat.Mode,
-			hash,
+		cset[rel] = info
+		from[rel] = filestat.Name
+	}
+	full := fullDirectories(cset)
+	for _, rel := range SortedNames(cset) {
+		if under := full[rel]; under != "" && !cset[rel].Mode.IsDir() {
+			if !conflicts[rel] {
+				errs <- &FileError { rel, fmt.Errorf("%s goes here, but %s goes under it", from[rel], from[under]) }
+			}
+			delete(cset, rel)
 		}
 	}
+	dropFullDirectories(cset, full)
+	close(errs)
 	result <- cset
-}
\ No newline at end of file
+}
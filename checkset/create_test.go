@@ -0,0 +1,80 @@
+package checkset
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// a file or directory to give Create, from one of several sources
+type createFile struct {
+	source string
+	path string // in the release
+	dir bool
+}
+
+// Create a CheckSet of files, returning it and the names it failed
+func createFrom(t *testing.T, files []createFile) (CheckSet, []string) {
+	root := tempDir(t)
+	infos := make(chan CreateInfo)
+	result := make(chan CheckSet)
+	errs := make(chan *FileError)
+	go Create("", infos, result, errs)
+	go func() {
+		for _, file := range files {
+			name := filepath.Join(root, file.source, filepath.FromSlash(file.path))
+			mode := os.FileMode(0644)
+			if file.dir {
+				mode = os.ModeDir | 0755
+				os.MkdirAll(name, 0755)
+			} else {
+				os.MkdirAll(filepath.Dir(name), 0755)
+				ioutil.WriteFile(name, []byte(file.path), 0644)
+			}
+			infos <- CreateInfo { Name: name, Mode: mode, Size: int64(len(file.path)), Target: AllPlatforms, Path: file.path }
+		}
+		close(infos)
+	}()
+	var failed []string
+	for err := range errs {
+		failed = append(failed, err.Name)
+	}
+	sort.Strings(failed)
+	return <-result, failed
+}
+
+func TestCreateConflicts(t *testing.T) {
+	tests := []struct {
+		files []createFile
+		names []string // in the checkset
+		failed []string
+	} {
+		// file over file
+		{ []createFile { { "1", "a", false }, { "2", "a", false }, { "1", "b", false } },
+			[]string { "a", "b" }, []string { "a" } },
+		// file over directory and the other way round
+		{ []createFile { { "1", "a", true }, { "2", "a", false } },
+			[]string { "a" }, []string { "a" } },
+		{ []createFile { { "1", "a", false }, { "2", "a", true } },
+			[]string { "a" }, []string { "a" } },
+		// file where another source has things under it
+		{ []createFile { { "1", "a", false }, { "2", "a", true }, { "2", "a/b", false } },
+			[]string { "a/b" }, []string { "a" } },
+		{ []createFile { { "1", "a/b", false }, { "2", "a", false } },
+			[]string { "a/b" }, []string { "a" } },
+		// directories merge, and only empty ones are listed
+		{ []createFile { { "1", "d", true }, { "1", "d/x", false }, { "2", "d", true }, { "2", "d/y", false } },
+			[]string { "d/x", "d/y" }, nil },
+		{ []createFile { { "1", "e", true }, { "2", "e", true } },
+			[]string { "e" }, nil },
+	}
+	for i, test := range tests {
+		cset, failed := createFrom(t, test.files)
+		if names := SortedNames(cset); !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(failed, test.failed) {
+			t.Errorf("%d: got %v, failing %v; want %v, failing %v", i, names, failed, test.names, test.failed)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// errors.go - errors concerning particular files
+
+package checkset
+
+import (
+	"fmt"
+)
+
+// an error concerning one file, named as it is in the CheckSet
+type FileError struct {
+	Name string
+	Err error
+}
+
+func (err *FileError) Error() string {
+	return err.Name + ": " + err.Err.Error()
+}
+
+func (err *FileError) Unwrap() error {
+	return err.Err
+}
+
+// errors concerning several files, in the order they happened
+type FileErrors []*FileError
+
+func (errs FileErrors) Error() string {
+	switch len(errs) {
+	case 0:
+		return "no errors"
+	case 1:
+		return errs[0].Error()
+	}
+	return fmt.Sprintf("%d files failed, starting with %s", len(errs), errs[0])
+}
+
+func (errs FileErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, err := range errs {
+		unwrapped[i] = err
+	}
+	return unwrapped
+}
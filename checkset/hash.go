@@ -12,19 +12,61 @@ import (
 const HashSize = 20
 
 func HashFile(path string) ([HashSize]byte, error) {
-	var hash [HashSize]byte
 	file, err := os.Open(path)
 	if err != nil {
-		return hash, err
+		return [HashSize]byte{}, err
 	}
 	defer file.Close()
+	return HashReader(file)
+}
+
+func HashReader(stream io.Reader) ([HashSize]byte, error) {
+	var hash [HashSize]byte
 	sha := sha1.New()
-	io.Copy(sha, file)
-	sum := sha.Sum(nil)
-	if copy(hash[:], sum) != HashSize {
+	_, err := io.Copy(sha, stream)
+	if err != nil {
+		return hash, err
+	}
+	if copy(hash[:], sha.Sum(nil)) != HashSize {
 		return hash, errors.New("hash was wrong size")
 	}
-	return hash, err
+	return hash, nil
+}
+
+// hash of the whole file and of each blockSize chunk of it
+func HashFileBlocks(path string, blockSize int64) ([HashSize]byte, [][HashSize]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return [HashSize]byte{}, nil, err
+	}
+	defer file.Close()
+	return HashReaderBlocks(file, blockSize)
+}
+
+func HashReaderBlocks(stream io.Reader, blockSize int64) ([HashSize]byte, [][HashSize]byte, error) {
+	var hash [HashSize]byte
+	var blocks [][HashSize]byte
+	sha := sha1.New()
+	for {
+		block := sha1.New()
+		n, err := io.CopyN(io.MultiWriter(sha, block), stream, blockSize)
+		if n > 0 {
+			var sum [HashSize]byte
+			copy(sum[:], block.Sum(nil))
+			blocks = append(blocks, sum)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return hash, blocks, err
+		}
+	}
+	copy(hash[:], sha.Sum(nil))
+	return hash, blocks, nil
+}
+
+func HashLink(target string) [HashSize]byte {
+	return sha1.Sum([]byte(target))
 }
 
 func CheckHash(path string, hash [HashSize]byte) bool {
@@ -0,0 +1,124 @@
+// index.go - what files looked like when a CheckSet was created
+
+package checkset
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// sizes and modification times of the files of a CheckSet, kept beside
+// it so that the next release can reuse the hashes of files that
+// haven't changed. not part of the release, since it would stop builds
+// of identical trees being identical.
+type Index struct {
+	// when hashing began. a file modified at or after this may have
+	// changed again since without its modification time changing.
+	Started time.Time
+	Files map[string]IndexEntry
+}
+
+type IndexEntry struct {
+	Size int64
+	ModTime time.Time
+}
+
+var IndexMagic = [8]uint8{'R', 'S', 'P', 'I', 'N', 'D', 'E', 'X'}
+
+const IndexVersion = 0
+
+// binary representation of an Index
+// a header, followed by Count entries, each followed by its name
+type IndexHeader struct {
+	Magic [8]uint8
+	Version uint16
+	Started int64 // unix nanoseconds
+	Count uint32
+}
+type IndexEntryHeader struct {
+	NameLength uint16
+	Size int64
+	ModTime int64 // unix nanoseconds
+}
+
+var BadIndex = errors.New("not a checkset index")
+
+func NewIndex(started time.Time) Index {
+	return Index { started, make(map[string]IndexEntry) }
+}
+
+func (index Index) Add(name string, fi os.FileInfo) {
+	index.Files[name] = IndexEntry { fi.Size(), fi.ModTime() }
+}
+
+// whether the file at name, now described by fi, is known not to have
+// changed since the index was made
+func (index Index) Unchanged(name string, fi os.FileInfo) bool {
+	entry, ok := index.Files[name]
+	return ok && entry.Size == fi.Size() && entry.ModTime.Equal(fi.ModTime()) &&
+		entry.ModTime.Before(index.Started)
+}
+
+func ReadIndex(stream io.Reader) (Index, error) {
+	var header IndexHeader
+	err := binary.Read(stream, binary.LittleEndian, &header)
+	if err != nil {
+		return Index{}, truncated(err)
+	} else if header.Magic != IndexMagic {
+		return Index{}, BadIndex
+	} else if header.Version > IndexVersion {
+		return Index{}, BadVersion
+	}
+	index := NewIndex(time.Unix(0, header.Started))
+	for i := uint32(0); i < header.Count; i++ {
+		var entry IndexEntryHeader
+		err = binary.Read(stream, binary.LittleEndian, &entry)
+		if err != nil {
+			return index, truncated(err)
+		}
+		name := make([]uint8, entry.NameLength)
+		_, err = io.ReadFull(stream, name)
+		if err != nil {
+			return index, truncated(err)
+		}
+		index.Files[string(name)] = IndexEntry { entry.Size, time.Unix(0, entry.ModTime) }
+	}
+	return index, nil
+}
+
+func WriteIndex(index Index, stream io.Writer) error {
+	header := IndexHeader { IndexMagic, IndexVersion, index.Started.UnixNano(), uint32(len(index.Files)) }
+	err := binary.Write(stream, binary.LittleEndian, header)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedIndexNames(index) {
+		entry := index.Files[name]
+		if len(name) > 0xffff {
+			return NameTooLong
+		}
+		err = binary.Write(stream, binary.LittleEndian,
+			IndexEntryHeader { uint16(len(name)), entry.Size, entry.ModTime.UnixNano() })
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(stream, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedIndexNames(index Index) []string {
+	names := make([]string, 0, len(index.Files))
+	for name := range index.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
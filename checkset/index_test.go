@@ -0,0 +1,78 @@
+package checkset
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUnchanged(t *testing.T) {
+	name := tempFile(t, "content")
+	started := time.Now()
+	before := started.Add(-time.Hour)
+	if err := os.Chtimes(name, before, before); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := NewIndex(started)
+	index.Add("file", fi)
+	if !index.Unchanged("file", fi) {
+		t.Error("file changed since it was indexed")
+	}
+	if index.Unchanged("other", fi) {
+		t.Error("unindexed file unchanged")
+	}
+	// modified as hashing began, so maybe again within the clock's
+	// resolution
+	index.Files["file"] = IndexEntry { fi.Size(), started }
+	if err := os.Chtimes(name, started, started); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ = os.Stat(name)
+	if index.Unchanged("file", fi) {
+		t.Error("file modified after hashing began unchanged")
+	}
+	index.Files["file"] = IndexEntry { fi.Size() + 1, before }
+	os.Chtimes(name, before, before)
+	fi, _ = os.Stat(name)
+	if index.Unchanged("file", fi) {
+		t.Error("file of another size unchanged")
+	}
+	index.Files["file"] = IndexEntry { fi.Size(), before.Add(-time.Second) }
+	if index.Unchanged("file", fi) {
+		t.Error("file with another time unchanged")
+	}
+}
+
+func TestReusable(t *testing.T) {
+	plain := CheckInfo { AllPlatforms, 0644, HashLink("12345678"), 8, "", 0, nil, nil }
+	blocked := plain
+	blocked.BlockSize = 2
+	blocked.Blocks = make([][HashSize]byte, 4)
+	link := CheckInfo { AllPlatforms, os.ModeSymlink | 0777, HashLink("a"), 1, "a", 0, nil, nil }
+	dir := CheckInfo { AllPlatforms, os.ModeDir | 0755, [HashSize]byte{}, 0, "", 0, nil, nil }
+	tests := []struct {
+		known CheckInfo
+		filestat CreateInfo
+		reusable bool
+	} {
+		{ plain, CreateInfo { Mode: 0644, Size: 8 }, true },
+		{ plain, CreateInfo { Mode: 0755, Size: 8 }, true }, // permissions aren't hashed
+		{ plain, CreateInfo { Mode: 0644, Size: 9 }, false },
+		{ plain, CreateInfo { Mode: os.ModeSymlink, Size: 8 }, false },
+		{ plain, CreateInfo { Mode: 0644, Size: 8, BlockSize: 2 }, false }, // no blocks to reuse
+		{ blocked, CreateInfo { Mode: 0644, Size: 8, BlockSize: 2 }, true },
+		{ blocked, CreateInfo { Mode: 0644, Size: 8, BlockSize: 4 }, false },
+		{ blocked, CreateInfo { Mode: 0644, Size: 8 }, true }, // blocks not wanted
+		{ link, CreateInfo { Mode: os.ModeSymlink, Size: 1 }, true },
+		{ dir, CreateInfo { Mode: os.ModeDir }, false },
+	}
+	for i, test := range tests {
+		if got := Reusable(test.known, test.filestat); got != test.reusable {
+			t.Errorf("%d: Reusable(%v, %+v) = %v", i, test.known.Mode, test.filestat, got)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// layout.go - where things other than release files live on a server
+
+package checkset
+
+import (
+	"encoding/hex"
+)
+
+// remote path of the file with hash in a content-addressed layout
+func ObjectPath(hash [HashSize]byte) string {
+	name := hex.EncodeToString(hash[:])
+	return "objects/" + name[:2] + "/" + name[2:]
+}
+
+// remote path of the patch from the file with hash base to the one
+// with hash target
+func PatchPath(base, target [HashSize]byte) string {
+	return "patches/" + hex.EncodeToString(base[:]) + "-" + hex.EncodeToString(target[:])
+}
@@ -0,0 +1,169 @@
+// lint.go - finding names in a CheckSet that will break on some clients
+
+package checkset
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// a way a release would break on some clients
+type Problem struct {
+	Name string
+	OS OperatingSystem // clients it breaks on
+	Message string
+}
+
+// longest path Windows programs can generally open, counted in UTF-16
+// units. this counts only the part of the path in the release, so
+// releases near it may still be too long once installed.
+const WindowsMaxPath = 260
+
+var windowsReserved = map[string]bool {
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// extensions of files no other OS has a use for
+var windowsOnly = map[string]bool {
+	".exe": true, ".dll": true, ".bat": true, ".cmd": true, ".msi": true,
+}
+
+// what is wrong with a path element on Windows, if anything
+func windowsElementProblem(element string) string {
+	stem := strings.TrimRight(strings.SplitN(element, ".", 2)[0], " ")
+	switch {
+	case windowsReserved[strings.ToUpper(stem)]:
+		return fmt.Sprintf("%q is a reserved name", element)
+	case strings.HasSuffix(element, ".") || strings.HasSuffix(element, " "):
+		return fmt.Sprintf("%q ends in a dot or space, which Windows drops", element)
+	}
+	for _, c := range element {
+		if c < 32 || strings.ContainsRune(`<>:"|?*`, c) {
+			return fmt.Sprintf("%q contains %q", element, c)
+		}
+	}
+	return ""
+}
+
+func lintName(name string, target OperatingSystem) []Problem {
+	var problems []Problem
+	add := func(os OperatingSystem, message string) {
+		if os != 0 {
+			problems = append(problems, Problem { name, os, message })
+		}
+	}
+	if !utf8.ValidString(name) {
+		add(target, "name is not valid UTF-8")
+	}
+	windows := target & Windows
+	for _, element := range strings.Split(name, "/") {
+		if message := windowsElementProblem(element); message != "" {
+			add(windows, message)
+		}
+	}
+	if length := len(utf16.Encode([]rune(name))); length > WindowsMaxPath {
+		add(windows, fmt.Sprintf("path is %d characters long, over %d", length, WindowsMaxPath))
+	}
+	if windowsOnly[strings.ToLower(path.Ext(name))] {
+		add(target &^ Windows, "Windows-only file isn't tagged for windows")
+	}
+	return problems
+}
+
+// OSes whose filesystems are case-insensitive by default
+const caseInsensitive = Windows | Darwin
+
+// names and the directories they are in that differ only in case, on
+// the OSes where that makes them collide
+func lintCase(cset CheckSet) []Problem {
+	type seenName struct {
+		name string
+		os OperatingSystem
+	}
+	var problems []Problem
+	seen := make(map[string]*seenName)
+	reported := make(map[string]bool)
+	for _, name := range SortedNames(cset) {
+		target := cset[name].Target.OS
+		for prefix := name; prefix != "."; prefix = path.Dir(prefix) {
+			folded := strings.ToLower(prefix)
+			first, ok := seen[folded]
+			if !ok {
+				seen[folded] = &seenName { prefix, target }
+				continue
+			}
+			if first.name == prefix {
+				first.os |= target
+				continue
+			}
+			both := first.os & target & caseInsensitive
+			if both != 0 && !reported[prefix] {
+				reported[prefix] = true
+				problems = append(problems, Problem { prefix, both,
+					fmt.Sprintf("differs only in case from %q, which collide on case-insensitive filesystems", first.name) })
+			}
+		}
+	}
+	return problems
+}
+
+// everything in cset that would break on some clients, by name
+func Lint(cset CheckSet) []Problem {
+	var problems []Problem
+	for name, info := range cset {
+		problems = append(problems, lintName(name, info.Target.OS)...)
+	}
+	problems = append(problems, lintCase(cset)...)
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Name < problems[j].Name
+	})
+	return problems
+}
+
+var osNames = []struct {
+	os OperatingSystem
+	name string
+} {
+	{ Linux, "linux" },
+	{ Darwin, "darwin" },
+	{ FreeBSD, "freebsd" },
+	{ OpenBSD, "openbsd" },
+	{ Windows, "windows" },
+	{ ^OperatingSystem(Linux | Darwin | FreeBSD | OpenBSD | Windows), "other" },
+}
+
+// writes problems grouped by the OSes they break on
+func WriteProblems(out io.Writer, problems []Problem) error {
+	for _, os := range osNames {
+		header := false
+		for _, problem := range problems {
+			if problem.OS & os.os == 0 {
+				continue
+			}
+			if !header {
+				if _, err := fmt.Fprintf(out, "%s:\n", os.name); err != nil {
+					return err
+				}
+				header = true
+			}
+			name := problem.Name
+			if !utf8.ValidString(name) {
+				name = strconv.Quote(name)
+			}
+			if _, err := fmt.Fprintf(out, "  %s: %s\n", name, problem.Message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
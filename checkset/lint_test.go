@@ -0,0 +1,100 @@
+package checkset
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func lintSet(targets map[string]OperatingSystem) CheckSet {
+	cset := make(CheckSet)
+	for name, target := range targets {
+		cset[name] = CheckInfo { Platform { target, AllArches }, 0644, HashLink(name), int64(len(name)), "", 0, nil, nil }
+	}
+	return cset
+}
+
+func TestLintName(t *testing.T) {
+	long := strings.Repeat("d/", 130) + "f" // 261 characters
+	// 259 characters, but 262 UTF-16 units
+	wide := strings.Repeat("d/", 128) + strings.Repeat("\U0001F600", 3)
+	tests := []struct {
+		name string
+		target OperatingSystem
+		os OperatingSystem // of the one problem expected, or 0 for none
+		message string
+	} {
+		{ "readme.txt", AllOSes, 0, "" },
+		{ "aux.cfg", AllOSes, Windows, "reserved" },
+		{ "dir/CON", AllOSes, Windows, "reserved" },
+		{ "com1 .txt", AllOSes, Windows, "reserved" },
+		{ "con/file", Windows | Linux, Windows, "reserved" },
+		{ "aux.cfg", Unix, 0, "" }, // not going to Windows
+		{ "console", AllOSes, 0, "" },
+		{ "name.", AllOSes, Windows, "dot or space" },
+		{ "dir./file", AllOSes, Windows, "dot or space" },
+		{ "name ", AllOSes, Windows, "dot or space" },
+		{ "a:b", AllOSes, Windows, "contains" },
+		{ "what?", AllOSes, Windows, "contains" },
+		{ "tab\there", AllOSes, Windows, "contains" },
+		{ "bad\xffname", Unix, Unix, "UTF-8" },
+		{ long, AllOSes, Windows, "over 260" },
+		{ long[2:], AllOSes, 0, "" }, // exactly 259
+		{ wide, AllOSes, Windows, "over 260" },
+		{ long, Unix, 0, "" },
+		{ "bin/app.exe", AllOSes, ^OperatingSystem(Windows), "tagged" },
+		{ "bin/APP.DLL", Linux | Windows, Linux, "tagged" },
+		{ "bin/app.exe", Windows, 0, "" },
+	}
+	for _, test := range tests {
+		problems := Lint(lintSet(map[string]OperatingSystem { test.name: test.target }))
+		if test.os == 0 {
+			if len(problems) > 0 {
+				t.Errorf("%q: got %+v, want none", test.name, problems)
+			}
+			continue
+		}
+		if len(problems) != 1 || problems[0].OS != test.os || !strings.Contains(problems[0].Message, test.message) {
+			t.Errorf("%q: got %+v, want one about %q for %x", test.name, problems, test.message, test.os)
+		}
+	}
+}
+
+func TestLintCase(t *testing.T) {
+	tests := []struct {
+		targets map[string]OperatingSystem
+		name string // reported, or "" for none
+		os OperatingSystem
+	} {
+		{ map[string]OperatingSystem { "Readme": AllOSes, "README": AllOSes }, "Readme", Windows | Darwin },
+		{ map[string]OperatingSystem { "a/x": AllOSes, "A/y": Windows | Linux }, "a", Windows },
+		{ map[string]OperatingSystem { "a": Windows, "A": Darwin }, "", 0 }, // never on the same client
+		{ map[string]OperatingSystem { "a": Linux | FreeBSD, "A": Linux }, "", 0 }, // case-sensitive
+		{ map[string]OperatingSystem { "a": Darwin, "A": Unix }, "a", Darwin },
+		{ map[string]OperatingSystem { "dir/a": AllOSes, "dir/b": AllOSes }, "", 0 },
+	}
+	for i, test := range tests {
+		problems := Lint(lintSet(test.targets))
+		if test.name == "" {
+			if len(problems) > 0 {
+				t.Errorf("%d: got %+v, want none", i, problems)
+			}
+			continue
+		}
+		if len(problems) != 1 || problems[0].Name != test.name || problems[0].OS != test.os {
+			t.Errorf("%d: got %+v, want %q for %x", i, problems, test.name, test.os)
+		}
+	}
+}
+
+func TestWriteProblems(t *testing.T) {
+	problems := Lint(lintSet(map[string]OperatingSystem { "aux": AllOSes, "bad\xff": Linux }))
+	var buf bytes.Buffer
+	if err := WriteProblems(&buf, problems); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "windows:\n  aux: ") || !strings.Contains(out, `"bad\xff": name is not valid UTF-8`) {
+		t.Errorf("wrote %q", out)
+	}
+}
@@ -0,0 +1,195 @@
+// meta.go - release metadata carried at the start of a CheckSet
+
+package checkset
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// information about the release a CheckSet describes
+type Meta struct {
+	Release string // name or version of the release
+	Built time.Time // when the release was generated; zero if unknown
+	MinUpdater uint16 // oldest updater version that understands the release
+	Channel string // e.g. "stable" or "testing"
+	Layout string // how files are laid out on the server
+	Extra map[string]string // free-form key/values
+}
+
+// values of Meta.Layout
+const (
+	PathLayout = "" // files are found at their path in the release
+	ContentLayout = "content" // files are found at their ObjectPath
+)
+
+// keys used to encode the named fields of Meta. Extra may not use them.
+const (
+	metaRelease = "release"
+	metaBuilt = "built"
+	metaMinUpdater = "min-updater"
+	metaChannel = "channel"
+	metaLayout = "layout"
+)
+
+// binary representation of Meta
+// a count of pairs, followed by that many length-prefixed key/value pairs
+type MetaHeader struct {
+	Count uint16
+}
+type MetaPairHeader struct {
+	KeyLength uint16
+	ValueLength uint16
+}
+
+var ReservedMetaKey = errors.New("extra metadata uses a reserved key")
+var BadMetaValue = errors.New("malformed metadata value")
+var MetaTooLong = errors.New("metadata too long")
+
+func isReservedMetaKey(key string) bool {
+	switch key {
+	case metaRelease, metaBuilt, metaMinUpdater, metaChannel, metaLayout:
+		return true
+	}
+	return false
+}
+
+// flatten meta into key/value pairs, leaving out empty fields
+func metaPairs(meta Meta) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for k, v := range meta.Extra {
+		if isReservedMetaKey(k) {
+			return nil, ReservedMetaKey
+		}
+		pairs[k] = v
+	}
+	if meta.Release != "" {
+		pairs[metaRelease] = meta.Release
+	}
+	if !meta.Built.IsZero() {
+		pairs[metaBuilt] = strconv.FormatInt(meta.Built.Unix(), 10)
+	}
+	if meta.MinUpdater != 0 {
+		pairs[metaMinUpdater] = strconv.FormatUint(uint64(meta.MinUpdater), 10)
+	}
+	if meta.Channel != "" {
+		pairs[metaChannel] = meta.Channel
+	}
+	if meta.Layout != PathLayout {
+		pairs[metaLayout] = meta.Layout
+	}
+	return pairs, nil
+}
+
+func setMetaPair(meta *Meta, key, value string) error {
+	switch key {
+	case metaRelease:
+		meta.Release = value
+	case metaBuilt:
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return BadMetaValue
+		}
+		meta.Built = time.Unix(secs, 0).UTC()
+	case metaMinUpdater:
+		version, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return BadMetaValue
+		}
+		meta.MinUpdater = uint16(version)
+	case metaChannel:
+		meta.Channel = value
+	case metaLayout:
+		meta.Layout = value
+	default:
+		if meta.Extra == nil {
+			meta.Extra = make(map[string]string)
+		}
+		meta.Extra[key] = value
+	}
+	return nil
+}
+
+func ReadMeta(stream io.Reader) (Meta, error) {
+	return readMeta(stream, DefaultLimits)
+}
+
+func readMeta(stream io.Reader, limits Limits) (Meta, error) {
+	var meta Meta
+	var header MetaHeader
+	err := binary.Read(stream, binary.LittleEndian, &header)
+	if err != nil {
+		return meta, truncated(err)
+	}
+	total := 0
+	for i := 0; i < int(header.Count); i++ {
+		var pair MetaPairHeader
+		err = binary.Read(stream, binary.LittleEndian, &pair)
+		if err != nil {
+			return meta, truncated(err)
+		}
+		length := int(pair.KeyLength) + int(pair.ValueLength)
+		total += length
+		if total > limits.MaxMetaLength {
+			return meta, MetaTooLong
+		}
+		data := make([]uint8, length)
+		_, err = io.ReadFull(stream, data)
+		if err != nil {
+			return meta, truncated(err)
+		}
+		key := string(data[:pair.KeyLength])
+		value := string(data[pair.KeyLength:])
+		err = setMetaPair(&meta, key, value)
+		if err != nil {
+			return meta, err
+		}
+	}
+	return meta, nil
+}
+
+// checks everything before writing anything, so that a Meta too long to
+// read back leaves no partial output
+func WriteMeta(stream io.Writer, meta Meta) error {
+	pairs, err := metaPairs(meta)
+	if err != nil {
+		return err
+	}
+	if len(pairs) > 0xffff {
+		return MetaTooLong
+	}
+	keys := make([]string, 0, len(pairs))
+	total := 0
+	for k, v := range pairs {
+		if len(k) > 0xffff || len(v) > 0xffff {
+			return MetaTooLong
+		}
+		total += len(k) + len(v)
+		keys = append(keys, k)
+	}
+	if total > DefaultLimits.MaxMetaLength {
+		return MetaTooLong
+	}
+	sort.Strings(keys)
+	err = binary.Write(stream, binary.LittleEndian, MetaHeader { uint16(len(pairs)) })
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		v := pairs[k]
+		pair := MetaPairHeader { uint16(len(k)), uint16(len(v)) }
+		err = binary.Write(stream, binary.LittleEndian, pair)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(stream, k + v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
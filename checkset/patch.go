@@ -0,0 +1,73 @@
+// patch.go - update files by patching an older version of them
+
+package checkset
+
+import (
+	"context"
+	"errors"
+	"github.com/rspeele/check-update/delta"
+	"github.com/rspeele/check-update/futility"
+	"os"
+)
+
+var NoPatch = errors.New("no patch from the local version of file")
+var PatchFailed = errors.New("patched file differs from expected")
+
+func hasHash(hashes [][HashSize]byte, hash [HashSize]byte) bool {
+	for i := range hashes {
+		if hashes[i] == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func CanPatch(info CheckInfo) bool {
+	return len(info.Bases) > 0 && info.Mode & os.ModeType == 0
+}
+
+// build the patched file next to local and only replace local with it
+// once it is known to be right
+func applyPatch(ctx context.Context, local, temp string, info CheckInfo, patch string, get Retriever) error {
+	read, err := get(ctx, patch)
+	if err != nil {
+		return err
+	}
+	defer read.Close()
+	old, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	write, err := futility.Create(temp, info.Mode & permBits)
+	if err != nil {
+		return err
+	}
+	err = delta.Apply(old, read, write)
+	write.Close()
+	if err != nil {
+		return err
+	}
+	if !CheckHash(temp, info.Hash) {
+		return PatchFailed
+	}
+	return nil
+}
+
+// patch the file at local, if there is a patch from its current version
+func Patch(ctx context.Context, local string, info CheckInfo, get Retriever) error {
+	base, err := HashFile(local)
+	if err != nil {
+		return err
+	}
+	if !hasHash(info.Bases, base) {
+		return NoPatch
+	}
+	temp := local + ".patched"
+	err = applyPatch(ctx, local, temp, info, PatchPath(base, info.Hash), get)
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return futility.Replace(temp, local)
+}
@@ -36,8 +36,16 @@ func parseSingleOS(name string) uint {
 		return AllOSes
 	case "windows":
 		return Windows
-	case "unix", "linux", "darwin", "openbsd", "freebsd":
+	case "unix":
 		return Unix
+	case "linux":
+		return Linux
+	case "darwin":
+		return Darwin
+	case "freebsd":
+		return FreeBSD
+	case "openbsd":
+		return OpenBSD
 	}
 	return 0
 }
@@ -47,10 +55,24 @@ func ParseOS(repr string) (OperatingSystem, error) {
 	return OperatingSystem(os), err
 }
 
+// the OS bits a GOOS runs files for
+func osOf(goos string) OperatingSystem {
+	switch goos {
+	case "android":
+		return Linux
+	case "ios":
+		return Darwin
+	case "aix", "dragonfly", "hurd", "illumos", "netbsd", "solaris":
+		return OtherUnix
+	}
+	return OperatingSystem(parseSingleOS(goos))
+}
+
 func CurrentOS() OperatingSystem {
-	os := OperatingSystem(parseSingleOS(runtime.GOOS))
+	os := osOf(runtime.GOOS)
 	if os == 0 {
-		os = AllOSes
+		// neither unix-like nor windows, like js and plan9
+		os = ^OperatingSystem(Unix | Windows)
 	}
 	return os
 }
@@ -65,6 +87,12 @@ func parseSingleArch(repr string) uint {
 		return AMD64
 	case "arm":
 		return ARM
+	case "arm64":
+		return ARM64
+	case "riscv64":
+		return RISCV64
+	case "ppc64le":
+		return PPC64LE
 	}
 	return 0
 }
@@ -73,20 +101,28 @@ func ParseArch(repr string) (Architecture, error) {
 	return Architecture(os), err
 }
 
-func CurrentArch() Architecture {
-	arch := Architecture(parseSingleArch(runtime.GOARCH))
+// the Architecture bits a GOARCH runs files for. those without a bit of
+// their own, like mips and s390x, get the bits of none of the others, so
+// that files for one named arch don't go to them.
+func archOf(goarch string) Architecture {
+	arch := Architecture(parseSingleArch(goarch))
 	if arch == 0 {
-		arch = AllArches
+		arch = ^Architecture(I386 | AMD64 | ARM | ARM64 | RISCV64 | PPC64LE)
 	}
 	return arch
 }
 
+func CurrentArch() Architecture {
+	return archOf(runtime.GOARCH)
+}
+
 // parse a string representing a platform
 // examples
 // unix
+// linux|darwin
 // :386
-// !windows:!arm
-// :!arm,amd64
+// ^windows:^arm
+// :amd64|arm64
 func ParsePlatform(spec string) (Platform, error) {
 	bisect := strings.Split(spec, ":")
 	lspec := bisect[0]
@@ -113,6 +149,65 @@ func CurrentPlatform() Platform {
 	}
 }
 
+// the Target of packs before version 5, which had only these bits.
+// Unix covered every unix-like OS. complements such as ^arm set the
+// unused high bits, which now stand for everything added since.
+type NarrowPlatform struct {
+	OS uint8
+	Arch uint8
+}
+
+const (
+	narrowUnix = 1
+	narrowWindows = 2
+	narrowOSes = narrowUnix | narrowWindows
+	narrowArches = I386 | AMD64 | ARM
+	narrowRest = 0x80
+)
+
+func WidenPlatform(narrow NarrowPlatform) Platform {
+	var os OperatingSystem
+	if narrow.OS & narrowUnix != 0 {
+		os |= Unix
+	}
+	if narrow.OS & narrowWindows != 0 {
+		os |= Windows
+	}
+	if narrow.OS & narrowRest != 0 {
+		os |= ^OperatingSystem(Unix | Windows)
+	}
+	arch := Architecture(narrow.Arch & narrowArches)
+	if narrow.Arch & narrowRest != 0 {
+		arch |= ^Architecture(narrowArches)
+	}
+	return Platform { os, arch }
+}
+
+// as near as a NarrowPlatform comes to platform. any unix-like OS
+// becomes all of them.
+func NarrowPlatformOf(platform Platform) NarrowPlatform {
+	var narrow NarrowPlatform
+	if platform.OS & Unix != 0 {
+		narrow.OS |= narrowUnix
+	}
+	if platform.OS & Windows != 0 {
+		narrow.OS |= narrowWindows
+	}
+	if platform.OS &^ (Unix | Windows) != 0 {
+		narrow.OS |= ^uint8(narrowOSes)
+	}
+	narrow.Arch = uint8(platform.Arch & narrowArches)
+	if platform.Arch &^ narrowArches != 0 {
+		narrow.Arch |= ^uint8(narrowArches)
+	}
+	return narrow
+}
+
+// whether readers going by the NarrowPlatform of platform see it as it is
+func IsNarrow(platform Platform) bool {
+	return WidenPlatform(NarrowPlatformOf(platform)) == platform
+}
+
 func MatchPlatform(host, target Platform) bool {
 	return host.OS & target.OS != 0 && host.Arch & target.Arch != 0
 }
\ No newline at end of file
@@ -0,0 +1,96 @@
+package checkset
+
+import (
+	"testing"
+)
+
+func TestOSOf(t *testing.T) {
+	tests := map[string]OperatingSystem {
+		"linux": Linux,
+		"android": Linux,
+		"darwin": Darwin,
+		"ios": Darwin,
+		"freebsd": FreeBSD,
+		"openbsd": OpenBSD,
+		"windows": Windows,
+		"netbsd": OtherUnix,
+		"illumos": OtherUnix,
+		"solaris": OtherUnix,
+		"plan9": 0,
+		"js": 0,
+	}
+	for goos, want := range tests {
+		if got := osOf(goos); got != want {
+			t.Errorf("%s: got %x, want %x", goos, got, want)
+		}
+	}
+}
+
+func TestArchOf(t *testing.T) {
+	tests := map[string]Architecture {
+		"386": I386,
+		"amd64": AMD64,
+		"arm": ARM,
+		"arm64": ARM64,
+		"riscv64": RISCV64,
+		"ppc64le": PPC64LE,
+	}
+	for goarch, want := range tests {
+		if got := archOf(goarch); got != want {
+			t.Errorf("%s: got %x, want %x", goarch, got, want)
+		}
+	}
+	// the rest get files for any arch, or not for one they aren't
+	for _, goarch := range []string { "mips", "s390x", "wasm" } {
+		host := Platform { Linux, archOf(goarch) }
+		for spec, match := range map[string]bool { "": true, ":^arm": true, ":amd64": false, ":386|arm|arm64|riscv64|ppc64le": false } {
+			target, err := ParsePlatform(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if MatchPlatform(host, target) != match {
+				t.Errorf("%q matched %s: %v", spec, goarch, !match)
+			}
+		}
+	}
+}
+
+// files for unix go to unix-like OSes without a bit of their own, but
+// not those for any one of them
+func TestMatchOtherUnix(t *testing.T) {
+	host := Platform { OtherUnix, AMD64 }
+	for spec, match := range map[string]bool { "": true, "unix": true, "^windows": true, "linux|darwin": false, "windows": false } {
+		target, err := ParsePlatform(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if MatchPlatform(host, target) != match {
+			t.Errorf("%q matched netbsd: %v", spec, !match)
+		}
+	}
+}
+
+func TestIsNarrow(t *testing.T) {
+	tests := map[string]bool {
+		"": true,
+		"unix": true,
+		"windows": true,
+		"unix|windows:386|amd64|arm": true,
+		"^windows:^arm": true,
+		"^unix": true,
+		"linux": false,
+		"darwin|freebsd|openbsd|linux": false, // not netbsd and the like
+		"^linux": false,
+		"unix|windows:arm64": false,
+		":riscv64": false,
+	}
+	for spec, narrow := range tests {
+		platform, err := ParsePlatform(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsNarrow(platform) != narrow {
+			t.Errorf("%q: IsNarrow is %v", spec, !narrow)
+		}
+	}
+}
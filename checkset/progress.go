@@ -0,0 +1,165 @@
+// progress.go - reporting how verification and updates are going
+
+package checkset
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// a snapshot of how an update is going
+type Progress struct {
+	Checked int // files verified
+	Remaining int // files found bad, to be resolved and not yet
+	Bytes int64 // downloaded
+	Total int64 // expected to download in all
+	File string // being resolved, if any
+	Rate float64 // bytes per second since the first download
+	ETA time.Duration // -1 if unknown
+}
+
+// collects events from Verify and Apply and passes each new Progress to
+// a function. all methods may be called on a nil Tracker, which does
+// nothing.
+type Tracker struct {
+	lock sync.Mutex
+	state Progress
+	started time.Time
+	report func(Progress)
+}
+
+func NewTracker(report func(Progress)) *Tracker {
+	return &Tracker { report: report }
+}
+
+// report the state; call with lock held
+func (tracker *Tracker) send() {
+	state := tracker.state
+	state.ETA = -1
+	if !tracker.started.IsZero() {
+		elapsed := time.Since(tracker.started).Seconds()
+		if elapsed > 0 {
+			state.Rate = float64(state.Bytes) / elapsed
+		}
+		if state.Rate > 0 && state.Total >= state.Bytes {
+			state.ETA = time.Duration(float64(state.Total - state.Bytes) / state.Rate * float64(time.Second))
+		}
+	}
+	tracker.report(state)
+}
+
+func (tracker *Tracker) update(change func(*Progress)) {
+	if tracker == nil {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	change(&tracker.state)
+	tracker.send()
+}
+
+// bytes that resolving bad will download, as far as we know
+func downloadSize(bad BadFile) int64 {
+	if bad.Reason == PermMismatch || bad.Info.Mode & os.ModeType != 0 || bad.Info.Size == UnknownSize {
+		return 0
+	}
+	return bad.Info.Size
+}
+
+func (tracker *Tracker) Checked() {
+	tracker.update(func(state *Progress) {
+		state.Checked++
+	})
+}
+
+// count bad as to be resolved. Verify leaves this to whatever passes bad
+// files on to Apply, so that those left alone aren't counted.
+func (tracker *Tracker) Found(bad BadFile) {
+	tracker.update(func(state *Progress) {
+		state.Remaining++
+		state.Total += downloadSize(bad)
+	})
+}
+
+// expect to download size more bytes besides those of bad files
+func (tracker *Tracker) Expect(size int64) {
+	tracker.update(func(state *Progress) {
+		state.Total += size
+	})
+}
+
+func (tracker *Tracker) Resolving(bad BadFile) {
+	tracker.update(func(state *Progress) {
+		state.File = bad.Remote
+	})
+}
+
+func (tracker *Tracker) Resolved(bad BadFile) {
+	tracker.update(func(state *Progress) {
+		state.File = ""
+		state.Remaining--
+	})
+}
+
+func (tracker *Tracker) Downloaded(n int) {
+	tracker.update(func(state *Progress) {
+		if tracker.started.IsZero() {
+			tracker.started = time.Now()
+		}
+		state.Bytes += int64(n)
+	})
+}
+
+type trackedReader struct {
+	stream io.ReadCloser
+	tracker *Tracker
+}
+
+func (read *trackedReader) Read(p []byte) (int, error) {
+	n, err := read.stream.Read(p)
+	if n > 0 {
+		read.tracker.Downloaded(n)
+	}
+	return n, err
+}
+
+func (read *trackedReader) Close() error {
+	return read.stream.Close()
+}
+
+// returns stream, counting what is read from it as downloaded
+func (tracker *Tracker) Reader(stream io.ReadCloser) io.ReadCloser {
+	if tracker == nil {
+		return stream
+	}
+	return &trackedReader { stream, tracker }
+}
+
+// returns src, counting everything it retrieves as downloaded
+func (tracker *Tracker) Source(src Source) Source {
+	if tracker == nil {
+		return src
+	}
+	get := src.Get
+	src.Get = func(ctx context.Context, name string) (io.ReadCloser, error) {
+		stream, err := get(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return tracker.Reader(stream), nil
+	}
+	if src.Range != nil {
+		getRange := src.Range
+		src.Range = func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+			stream, err := getRange(ctx, name, offset, length)
+			if err != nil {
+				return nil, err
+			}
+			return tracker.Reader(stream), nil
+		}
+	}
+	return src
+}
@@ -0,0 +1,87 @@
+package checkset
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// keeps the last Progress reported
+type lastProgress struct {
+	lock sync.Mutex
+	progress Progress
+}
+
+func (last *lastProgress) report(p Progress) {
+	last.lock.Lock()
+	defer last.lock.Unlock()
+	last.progress = p
+}
+
+func (last *lastProgress) get() Progress {
+	last.lock.Lock()
+	defer last.lock.Unlock()
+	return last.progress
+}
+
+func TestTracker(t *testing.T) {
+	root := tempDir(t)
+	os.WriteFile(filepath.Join(root, "same"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(root, "b"), []byte("zzzz"), 0644)
+	files := map[string]string { "same": "x", "a": "123", "b": "4567" }
+	cset := make(CheckSet)
+	for name, content := range files {
+		cset[name] = fileInfo(content)
+	}
+	var last lastProgress
+	tracker := NewTracker(last.report)
+	failed := make(chan BadFile)
+	go Verify(context.Background(), root, cset, failed, tracker)
+	var bads []BadFile
+	for bad := range failed {
+		tracker.Found(bad)
+		bads = append(bads, bad)
+	}
+	checked := last.get()
+	want := Progress { Checked: 3, Remaining: 2, Total: 7, ETA: -1 }
+	if len(bads) != 2 || checked != want {
+		t.Errorf("after verifying, found %d and got %+v; want %+v", len(bads), checked, want)
+	}
+	todo := make(chan BadFile, len(bads))
+	for _, bad := range bads {
+		todo <- bad
+	}
+	close(todo)
+	done := make(chan Resolution)
+	go Apply(context.Background(), root, stringSource(files), todo, done, tracker)
+	for res := range done {
+		if res.Err != nil {
+			t.Errorf("%s: %v", res.Bad.Remote, res.Err)
+		}
+	}
+	final := last.get()
+	if final.Checked != 3 || final.Remaining != 0 || final.Bytes != 7 || final.Total != 7 || final.File != "" {
+		t.Errorf("after applying, got %+v", final)
+	}
+	if final.Rate <= 0 || final.ETA != 0 {
+		t.Errorf("got rate %v and ETA %v once everything was downloaded", final.Rate, final.ETA)
+	}
+	tracker.Expect(5)
+	if got := last.get(); got.Total != 12 || got.ETA <= 0 {
+		t.Errorf("expecting 5 more bytes gave %+v", got)
+	}
+}
+
+func TestNilTracker(t *testing.T) {
+	var tracker *Tracker
+	tracker.Checked()
+	tracker.Found(BadFile{})
+	tracker.Expect(1)
+	tracker.Downloaded(1)
+	src := stringSource(nil)
+	if tracker.Source(src).Get == nil {
+		t.Error("nil tracker lost the source")
+	}
+}
@@ -0,0 +1,111 @@
+// repair.go - fix only the blocks of a file that differ
+
+package checkset
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"github.com/rspeele/check-update/futility"
+	"io"
+	"os"
+)
+
+var RepairFailed = errors.New("file still differs after repairing blocks")
+
+func CanRepair(info CheckInfo, src Source) bool {
+	return src.Range != nil && info.BlockSize > 0 && len(info.Blocks) > 0 &&
+		info.Mode & os.ModeType == 0
+}
+
+// bounds of block i of a file like info
+func blockRange(info CheckInfo, i int) (int64, int64) {
+	offset := int64(i) * info.BlockSize
+	length := info.BlockSize
+	if offset + length > info.Size {
+		length = info.Size - offset
+	}
+	return offset, length
+}
+
+func fetchBlock(ctx context.Context, file *os.File, remote string, offset, length int64, get RangeRetriever) error {
+	read, err := get(ctx, remote, offset, length)
+	if err != nil {
+		return err
+	}
+	defer read.Close()
+	_, err = io.CopyN(io.NewOffsetWriter(file, offset), read, length)
+	return truncated(err)
+}
+
+// whether block i of file matches info, read without holding it all
+func blockMatches(file *os.File, info CheckInfo, i int) (bool, error) {
+	offset, length := blockRange(info, i)
+	sha := sha1.New()
+	n, err := io.Copy(sha, io.NewSectionReader(file, offset, length))
+	if err != nil {
+		return false, err
+	}
+	return n == length && bytes.Equal(sha.Sum(nil), info.Blocks[i][:]), nil
+}
+
+// re-fetch the blocks of the file at local which don't match info. they
+// are fixed in a copy next to local, which only replaces it once the
+// whole thing matches, so that local is left as it was if ctx is done
+// or the copy doesn't match. in that case, the file should be fetched
+// whole.
+func Repair(ctx context.Context, local string, info CheckInfo, remote string, get RangeRetriever) error {
+	temp := local + ".repair"
+	err := futility.CopyFile(local, temp, info.Mode & permBits)
+	if err == nil {
+		err = repairBlocks(ctx, temp, info, remote, get)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return futility.Replace(temp, local)
+}
+
+// fix the blocks of the file at name in place, stopping after the
+// current one once ctx is done
+func repairBlocks(ctx context.Context, name string, info CheckInfo, remote string, get RangeRetriever) error {
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = file.Truncate(info.Size)
+	if err != nil {
+		return err
+	}
+	for i := range info.Blocks {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		offset, length := blockRange(info, i)
+		if length <= 0 {
+			break
+		}
+		ok, err := blockMatches(file, info, i)
+		if err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+		err = fetchBlock(ctx, file, remote, offset, length, get)
+		if err != nil {
+			return err
+		}
+	}
+	file.Sync()
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	if !CheckHash(name, info.Hash) {
+		return RepairFailed
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package checkset
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// serves content, counting the ranges asked for. ranges are refused if
+// whole is set.
+type rangeServer struct {
+	content string
+	whole bool
+	ranges int
+}
+
+func (server *rangeServer) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(server.content)), nil
+}
+
+func (server *rangeServer) Range(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if server.whole {
+		return nil, NoRanges
+	}
+	server.ranges++
+	return ioutil.NopCloser(strings.NewReader(server.content[offset:offset + length])), nil
+}
+
+func (server *rangeServer) Source() Source {
+	return Source { Get: server.Get, Range: server.Range }
+}
+
+func blockInfo(t *testing.T, content string, blockSize int64) CheckInfo {
+	hash, blocks, err := HashReaderBlocks(strings.NewReader(content), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CheckInfo { AllPlatforms, 0644, hash, int64(len(content)), "", blockSize, blocks, nil }
+}
+
+func tempFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "checkset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	name := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(name, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestHashFileBlocks(t *testing.T) {
+	content := "0123456789"
+	hash, blocks, err := HashFileBlocks(tempFile(t, content), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != sha1.Sum([]byte(content)) {
+		t.Error("whole file hash differs from sha1 of the file")
+	}
+	want := []string { "0123", "4567", "89" }
+	if len(blocks) != len(want) {
+		t.Fatalf("got %d blocks, want %d", len(blocks), len(want))
+	}
+	for i := range want {
+		if blocks[i] != sha1.Sum([]byte(want[i])) {
+			t.Errorf("block %d differs from sha1 of %q", i, want[i])
+		}
+	}
+	_, blocks, _ = HashFileBlocks(tempFile(t, ""), 4)
+	if len(blocks) != 0 {
+		t.Errorf("empty file has %d blocks", len(blocks))
+	}
+}
+
+func TestRepair(t *testing.T) {
+	want := "aaaabbbbccccdd"
+	info := blockInfo(t, want, 4)
+	cases := []struct {
+		local string
+		ranges int
+	} {
+		{ "aaaaXbbbccccdd", 1 },
+		{ "aaaabbbbccccddEXTRA", 0 },
+		{ "aaaabbbbcc", 2 },
+		{ "XaaabbbbccccdX", 2 },
+	}
+	for _, c := range cases {
+		local := tempFile(t, c.local)
+		server := &rangeServer { content: want }
+		err := Repair(context.Background(), local, info, "file", server.Range)
+		if err != nil {
+			t.Errorf("%q: %v", c.local, err)
+			continue
+		}
+		got, _ := ioutil.ReadFile(local)
+		if string(got) != want {
+			t.Errorf("%q repaired to %q", c.local, got)
+		}
+		if server.ranges != c.ranges {
+			t.Errorf("%q: fetched %d blocks, want %d", c.local, server.ranges, c.ranges)
+		}
+	}
+}
+
+// a server without ranges gets the whole file fetched instead
+func TestResolveWithoutRanges(t *testing.T) {
+	want := "aaaabbbbccccdd"
+	info := blockInfo(t, want, 4)
+	local := tempFile(t, "aaaaXbbbccccdd")
+	server := &rangeServer { content: want, whole: true }
+	src := server.Source()
+	if !CanRepair(info, src) {
+		t.Fatal("can't repair a file with blocks from a source with ranges")
+	}
+	bad := BadFile { Remote: "file", Info: info, Reason: HashMismatch }
+	err := Resolve(context.Background(), filepath.Dir(local), bad, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(local)
+	if string(got) != want {
+		t.Errorf("resolved to %q, want %q", got, want)
+	}
+}
+
+func TestReadBadBlocks(t *testing.T) {
+	good := blockInfo(t, "aaaabbbbcc", 4)
+	huge := good
+	huge.BlockSize = 1<<32 - 1
+	short := good
+	short.Blocks = short.Blocks[:2]
+	for _, info := range []CheckInfo { huge, short } {
+		_, _, err := Read(bytes.NewReader(encodeRawInfo(t, "a", info)))
+		if parseError(t, err).Err != BadBlocks {
+			t.Errorf("block size %d, %d blocks: got %v, want BadBlocks", info.BlockSize, len(info.Blocks), err)
+		}
+	}
+}
+
+// cancelling part way leaves the file as it was
+func TestRepairCancelled(t *testing.T) {
+	want := "aaaabbbbccccdd"
+	info := blockInfo(t, want, 4)
+	local := tempFile(t, "XaaabbbbccccdX")
+	server := &rangeServer { content: want }
+	ctx, cancel := context.WithCancel(context.Background())
+	get := func(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+		cancel()
+		return server.Range(ctx, name, offset, length)
+	}
+	err := Repair(ctx, local, info, "file", get)
+	if err != context.Canceled || server.ranges != 1 {
+		t.Errorf("got %v after %d blocks, want to stop after one", err, server.ranges)
+	}
+	if got := readFile(t, local); got != "XaaabbbbccccdX" {
+		t.Errorf("left %q", got)
+	}
+	if _, err := os.Stat(local + ".repair"); err == nil {
+		t.Error("left the copy being repaired")
+	}
+}
@@ -3,19 +3,29 @@
 package checkset
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
 	"os"
 )
 
-// bump when protocol breaks compatibility
-const ProtocolVersion = 0
+// bump when the encoding changes in a way readers can tell from the
+// version alone. readers accept newer versions, so a change older
+// readers can't safely ignore must also set Meta.MinUpdater.
+// 0: entries only
+// 1: Meta follows the header
+// 2: CheckPackInfo carries Size
+// 3: full file modes, symlinks and empty directories
+// 4: entries are sorted by name, without duplicates, so that readers
+//    can check for duplicates without remembering every name
+// 5: 32-bit platforms, distinguishing unix-like OSes
+const ProtocolVersion = 5
 
 // binary representation of a CheckSet entry
 // everything is encoded in little-endian
 
-// header occuring once per CheckSet
+// header occuring once per CheckSet, followed by its Meta
 type CheckSetHeader struct {
 	Magic [8]uint8
 	Version uint16
@@ -25,16 +35,66 @@ type CheckPackHeader struct {
 	NameLength uint16
 	InfoLength uint16
 }
+// the first FixedLength bytes of the info are the fields below; the
+// rest is variable-length data whose lengths are given by those fields,
+// in the order they are listed
 type CheckPackInfo struct {
-	Target Platform
-	Mode uint16
+	Target NarrowPlatform // nearest to WideTarget, for readers predating it
+	Mode uint16 // low bits of FullMode, for readers predating it
 	Hash [HashSize]uint8
+	Size uint64
+	FixedLength uint16
+	FullMode uint32
+	LinkLength uint16 // symlink target
+	BlockSize uint32
+	BlockCount uint32 // hashes of each block
+	BaseCount uint16 // hashes of files there are patches from
+	// from version 5. readers predating it go by Target, and releases
+	// they would get wrong say so with Meta.MinUpdater.
+	WideTarget Platform
 	Future [0]uint8
 }
 type CheckPack struct {
 	Header CheckPackHeader
 	Name []uint8
 	Info CheckPackInfo
+	Link []uint8
+	Blocks []uint8
+	Bases []uint8
+}
+
+// CheckPackInfo only ever grows at the end. a field is present in a
+// pack if its fixed length reaches the end of that field.
+const (
+	infoLengthV0 = 24 // Target, Mode, Hash
+	infoLengthSize = infoLengthV0 + 8
+	infoLengthLink = infoLengthSize + 2 + 4 + 2
+	infoLengthBlocks = infoLengthLink + 4 + 4
+	infoLengthBases = infoLengthBlocks + 2
+	infoLengthPlatform = infoLengthBases + 4 + 4
+)
+
+// Size as encoded when it is UnknownSize
+const unknownPackSize = ^uint64(0)
+
+var PackTooLong = errors.New("name, symlink target, blocks or bases too long for checkset")
+
+func flattenHashes(hashes [][HashSize]byte) []uint8 {
+	flat := make([]uint8, 0, len(hashes) * HashSize)
+	for i := range hashes {
+		flat = append(flat, hashes[i][:]...)
+	}
+	return flat
+}
+
+func splitHashes(flat []uint8) [][HashSize]byte {
+	var hashes [][HashSize]byte
+	for i := 0; i + HashSize <= len(flat); i += HashSize {
+		var hash [HashSize]byte
+		copy(hash[:], flat[i:])
+		hashes = append(hashes, hash)
+	}
+	return hashes
 }
 
 var CurrentVersionHeader = CheckSetHeader {
@@ -42,54 +102,187 @@ var CurrentVersionHeader = CheckSetHeader {
 	ProtocolVersion,
 }
 
-func EncodeCheckPack(path string, info CheckInfo) CheckPack {
+func EncodeCheckPack(path string, info CheckInfo) (CheckPack, error) {
+	var pack CheckPack
+	size := uint64(info.Size)
+	if info.Size == UnknownSize {
+		size = unknownPackSize
+	}
+	blocks := flattenHashes(info.Blocks)
+	bases := flattenHashes(info.Bases)
+	tail := len(info.Link) + len(blocks) + len(bases)
+	if len(path) > 0xffff || tail > 0xffff - infoLengthPlatform {
+		return pack, PackTooLong
+	}
 	packinfo := CheckPackInfo {
-		info.Target,
+		NarrowPlatformOf(info.Target),
 		uint16(info.Mode),
 		[HashSize]uint8(info.Hash),
+		size,
+		0,
+		uint32(info.Mode),
+		uint16(len(info.Link)),
+		uint32(info.BlockSize),
+		uint32(len(info.Blocks)),
+		uint16(len(info.Bases)),
+		info.Target,
 		[0]byte{},
 	}
+	packinfo.FixedLength = uint16(binary.Size(&packinfo))
 	header := CheckPackHeader {
 		uint16(len(path)),
-		uint16(binary.Size(&packinfo)),
+		packinfo.FixedLength + uint16(tail),
 	}
 	return CheckPack {
 		header,
 		[]uint8(path),
 		packinfo,
+		[]uint8(info.Link),
+		blocks,
+		bases,
+	}, nil
+}
+
+// length of the fixed part of the pack's info
+func (pack *CheckPack) fixedLength() int {
+	if pack.Info.FixedLength != 0 {
+		return int(pack.Info.FixedLength)
 	}
+	return int(pack.Header.InfoLength)
 }
 
 func DecodeCheckPack(pack *CheckPack) (string, CheckInfo) {
+	return decodeCheckPack(pack, ProtocolVersion)
+}
+
+// decode pack as read from a checkset of the given version
+func decodeCheckPack(pack *CheckPack, version uint16) (string, CheckInfo) {
 	name := string(pack.Name)
+	fixed := pack.fixedLength()
 	mode := os.FileMode(pack.Info.Mode)
+	if fixed >= infoLengthLink {
+		mode = os.FileMode(pack.Info.FullMode)
+	}
+	target := pack.Info.WideTarget
+	if version < 5 || fixed < infoLengthPlatform {
+		target = WidenPlatform(pack.Info.Target)
+	}
+	size := int64(pack.Info.Size)
+	if fixed < infoLengthSize || pack.Info.Size == unknownPackSize {
+		size = UnknownSize
+	}
 	return name, CheckInfo {
-		pack.Info.Target,
+		target,
 		mode,
 		pack.Info.Hash,
+		size,
+		string(pack.Link),
+		int64(pack.Info.BlockSize),
+		splitHashes(pack.Blocks),
+		splitHashes(pack.Bases),
+	}
+}
+
+var BadInfoLength = errors.New("checkset entry has inconsistent lengths")
+
+// decode the fixed fields from the start of info. fields missing from
+// packs by older writers are left zeroed; extra ones from newer writers
+// are ignored.
+func decodePackInfo(info []uint8, packinfo *CheckPackInfo) error {
+	known := binary.Size(packinfo)
+	if len(info) < known {
+		info = append(info[:len(info):len(info)], make([]uint8, known - len(info))...)
+	}
+	return binary.Read(bytes.NewReader(info), binary.LittleEndian, packinfo)
+}
+
+var BadBlocks = errors.New("checkset entry's block hashes don't fit its size")
+
+// blocks must cover the file exactly, and be small enough to hold in memory
+func checkBlocks(info CheckPackInfo, limits Limits) error {
+	size := int64(info.Size)
+	blockSize := int64(info.BlockSize)
+	if blockSize == 0 || blockSize > limits.MaxBlockSize || info.Size == unknownPackSize ||
+		size <= 0 || (size - 1) / blockSize + 1 != int64(info.BlockCount) {
+		return BadBlocks
 	}
+	return nil
 }
 
 func ReadCheckPack(stream io.Reader) (CheckPack, error) {
+	return readCheckPack(stream, DefaultLimits)
+}
+
+// io.EOF from a read other than the first of a pack means it was cut short
+func truncated(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readCheckPack(stream io.Reader, limits Limits) (CheckPack, error) {
 	var pack CheckPack
 	err := binary.Read(stream, binary.LittleEndian, &pack.Header)
 	if err != nil {
 		return pack, err
 	}
+	if int(pack.Header.NameLength) > limits.MaxNameLength {
+		return pack, NameTooLong
+	} else if int(pack.Header.InfoLength) > limits.MaxInfoLength {
+		return pack, InfoTooLong
+	}
 	name := make([]uint8, pack.Header.NameLength)
 	_, err = io.ReadFull(stream, name)
 	if err != nil {
-		return pack, err
+		return pack, truncated(err)
 	}
 	pack.Name = name
-	err = binary.Read(stream, binary.LittleEndian, &pack.Info)
+	info := make([]uint8, pack.Header.InfoLength)
+	_, err = io.ReadFull(stream, info)
+	if err != nil {
+		return pack, truncated(err)
+	}
+	err = decodePackInfo(info, &pack.Info)
 	if err != nil {
 		return pack, err
 	}
-	extra := binary.Size(&pack.Info) - int(pack.Header.InfoLength)
-	if extra > 0 {
-		ignore := make([]uint8, extra)
-		_, err = io.ReadFull(stream, ignore)
+	fixed := pack.fixedLength()
+	if fixed > len(info) {
+		return pack, BadInfoLength
+	}
+	// decode again without the variable-length data, which would
+	// otherwise be mistaken for fields we know and the writer didn't
+	err = decodePackInfo(info[:fixed], &pack.Info)
+	if err != nil {
+		return pack, err
+	}
+	tail := info[fixed:]
+	if fixed >= infoLengthLink {
+		if int(pack.Info.LinkLength) > len(tail) {
+			return pack, BadInfoLength
+		}
+		pack.Link = tail[:pack.Info.LinkLength]
+		tail = tail[pack.Info.LinkLength:]
+	}
+	if fixed >= infoLengthBlocks && pack.Info.BlockCount > 0 {
+		length := int64(pack.Info.BlockCount) * HashSize
+		if length > int64(len(tail)) {
+			return pack, BadInfoLength
+		}
+		err = checkBlocks(pack.Info, limits)
+		if err != nil {
+			return pack, err
+		}
+		pack.Blocks = tail[:length]
+		tail = tail[length:]
+	}
+	if fixed >= infoLengthBases && pack.Info.BaseCount > 0 {
+		length := int(pack.Info.BaseCount) * HashSize
+		if length > len(tail) {
+			return pack, BadInfoLength
+		}
+		pack.Bases = tail[:length]
 	}
 	return pack, err
 }
@@ -103,42 +296,53 @@ func WriteCheckPack(stream io.Writer, pack CheckPack) error {
 		return err
 	}
 	err = binary.Write(stream, binary.LittleEndian, pack.Info)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(pack.Link)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(pack.Blocks)
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(pack.Bases)
 	return err
 }
 
 var BadMagic = errors.New("Bad magic number for checkset")
-var BadVersion = errors.New("Mismatched protocol version")
+var BadVersion = errors.New("Checkset is from a newer protocol version")
 
-func Read(stream io.Reader) (CheckSet, error) {
-	var err error
-	var version CheckSetHeader
+func Read(stream io.Reader) (Meta, CheckSet, error) {
 	cset := make(CheckSet)
-	err = binary.Read(stream, binary.LittleEndian, &version)
-	if version.Magic != CurrentVersionHeader.Magic {
-		return cset, BadMagic
-	} else if version.Version != CurrentVersionHeader.Version {
-		return cset, BadVersion
+	reader, err := NewReader(stream)
+	if err != nil {
+		return reader.Meta, cset, err
 	}
 	for {
-		var pack CheckPack
-		pack, err = ReadCheckPack(stream)
+		var name string
+		var info CheckInfo
+		name, info, err = reader.Next()
 		if err != nil {
 			break
 		}
-		name, info := DecodeCheckPack(&pack)
 		cset[name] = info
 	}
 	if err == io.EOF {
 		err = nil
 	}
-	return cset, err
+	return reader.Meta, cset, err
 }
 
-func Write(cset CheckSet, stream io.Writer) error {
-	binary.Write(stream, binary.LittleEndian, CurrentVersionHeader)
-	for path, info := range cset {
-		pack := EncodeCheckPack(path, info)
-		err := WriteCheckPack(stream, pack)
+func Write(meta Meta, cset CheckSet, stream io.Writer) error {
+	writer, err := NewWriter(stream, meta)
+	if err != nil {
+		return err
+	}
+	// write in a fixed order so identical checksets encode identically
+	for _, path := range SortedNames(cset) {
+		err = writer.Write(path, cset[path])
 		if err != nil {
 			return err
 		}
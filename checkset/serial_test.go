@@ -0,0 +1,558 @@
+package checkset
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCheckSet() (Meta, CheckSet) {
+	meta := Meta {
+		Release: "1.2",
+		Built: time.Unix(1400000000, 0).UTC(),
+		MinUpdater: 1,
+		Channel: "stable",
+		Extra: map[string]string { "b": "2", "a": "1", "c": "3" },
+	}
+	cset := make(CheckSet)
+	for _, name := range []string { "z", "a/b", "m", "a", "b/c/d", "0" } {
+		cset[name] = CheckInfo { AllPlatforms, 0644, HashLink(name), int64(len(name)), "", 0, nil, nil }
+	}
+	cset["link"] = CheckInfo { AllPlatforms, os.ModeSymlink | 0777, HashLink("z"), 1, "z", 0, nil, nil }
+	cset["mac"] = CheckInfo { Platform { Darwin, AMD64 | ARM64 }, 0755, HashLink("mac"), 3, "", 0, nil, nil }
+	cset["dir"] = CheckInfo { AllPlatforms, os.ModeDir | 0755, [HashSize]byte{}, 0, "", 0, nil, nil }
+	cset["big"] = CheckInfo { AllPlatforms, 0644, HashLink("big"), 10, "", 4,
+		[][HashSize]byte { HashLink("1"), HashLink("2"), HashLink("3") },
+		[][HashSize]byte { HashLink("old") } }
+	return meta, cset
+}
+
+func TestWriteDeterministic(t *testing.T) {
+	meta, cset := testCheckSet()
+	var first bytes.Buffer
+	err := Write(meta, cset, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		var again bytes.Buffer
+		Write(meta, cset, &again)
+		if !bytes.Equal(first.Bytes(), again.Bytes()) {
+			t.Fatalf("write %d differs from the first", i)
+		}
+	}
+}
+
+func TestWriteSorted(t *testing.T) {
+	meta, cset := testCheckSet()
+	var buf bytes.Buffer
+	Write(meta, cset, &buf)
+	stream := bytes.NewReader(buf.Bytes())
+	var header CheckSetHeader
+	readHeader(t, stream, &header)
+	_, err := ReadMeta(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := ""
+	for i := 0; i < len(cset); i++ {
+		pack, err := ReadCheckPack(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pack.Name) <= last {
+			t.Errorf("%q written after %q", pack.Name, last)
+		}
+		last = string(pack.Name)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	meta, cset := testCheckSet()
+	var buf bytes.Buffer
+	Write(meta, cset, &buf)
+	rmeta, rcset, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rmeta.Release != meta.Release || !rmeta.Built.Equal(meta.Built) ||
+		rmeta.MinUpdater != meta.MinUpdater || rmeta.Channel != meta.Channel ||
+		len(rmeta.Extra) != len(meta.Extra) {
+		t.Errorf("read meta %+v, wrote %+v", rmeta, meta)
+	}
+	if len(rcset) != len(cset) {
+		t.Fatalf("read %d entries, wrote %d", len(rcset), len(cset))
+	}
+	for name, info := range cset {
+		if !reflect.DeepEqual(rcset[name], info) {
+			t.Errorf("%s: read %+v, wrote %+v", name, rcset[name], info)
+		}
+	}
+}
+
+// packs from before version 5 only have the narrow platform
+func TestDecodeNarrowPlatform(t *testing.T) {
+	cases := []struct {
+		narrow NarrowPlatform
+		wide Platform
+	} {
+		{ NarrowPlatform { 0xff, 0xff }, AllPlatforms },
+		{ NarrowPlatform { 1, 2 }, Platform { Unix, AMD64 } },
+		{ NarrowPlatform { 0xfd, 0xfb }, Platform { ^OperatingSystem(Windows), ^Architecture(ARM) } },
+	}
+	for _, c := range cases {
+		pack, err := EncodeCheckPack("a", CheckInfo { c.wide, 0644, HashLink("a"), 0, "", 0, nil, nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pack.Info.Target != c.narrow {
+			t.Errorf("%+v narrowed to %+v, want %+v", c.wide, pack.Info.Target, c.narrow)
+		}
+		pack.Info.WideTarget = Platform{}
+		pack.Info.FixedLength = infoLengthBases
+		_, info := DecodeCheckPack(&pack)
+		if info.Target != c.wide {
+			t.Errorf("%+v widened to %+v, want %+v", c.narrow, info.Target, c.wide)
+		}
+	}
+}
+
+// a version 4 checkset is read by its narrow platforms, whatever else
+// its packs carry
+func TestReadVersion4Platform(t *testing.T) {
+	var buf bytes.Buffer
+	header := CurrentVersionHeader
+	header.Version = 4
+	binary.Write(&buf, binary.LittleEndian, header)
+	WriteMeta(&buf, Meta{})
+	pack, err := EncodeCheckPack("a", CheckInfo { Platform { Linux, ARM64 }, 0644, HashLink("a"), 0, "", 0, nil, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	WriteCheckPack(&buf, pack)
+	_, cset, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := WidenPlatform(pack.Info.Target); cset["a"].Target != want {
+		t.Errorf("read %+v, want %+v", cset["a"].Target, want)
+	}
+}
+
+func TestWriteMetaTooLong(t *testing.T) {
+	long := strings.Repeat("x", 0x10000)
+	for _, meta := range []Meta {
+		{ Release: long },
+		{ Extra: map[string]string { "a": strings.Repeat("x", DefaultLimits.MaxMetaLength) } },
+	} {
+		var buf bytes.Buffer
+		err := WriteMeta(&buf, meta)
+		if err != MetaTooLong {
+			t.Errorf("got %v, want MetaTooLong", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("wrote %d bytes of a Meta too long to read", buf.Len())
+		}
+	}
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	started := time.Unix(1500000000, 123)
+	index := NewIndex(started)
+	index.Files["a/b"] = IndexEntry { 42, started.Add(-time.Hour) }
+	index.Files["c"] = IndexEntry { 0, started }
+	var buf bytes.Buffer
+	err := WriteIndex(index, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.Started.Equal(started) || len(read.Files) != len(index.Files) {
+		t.Fatalf("read %+v, wrote %+v", read, index)
+	}
+	for name, entry := range index.Files {
+		got := read.Files[name]
+		if got.Size != entry.Size || !got.ModTime.Equal(entry.ModTime) {
+			t.Errorf("%s: read %+v, wrote %+v", name, got, entry)
+		}
+	}
+}
+
+// creating checksets of identical trees gives identical bytes
+func TestCreateReproducible(t *testing.T) {
+	var outputs [2][]byte
+	for i := range outputs {
+		root, err := ioutil.TempDir("", "checkset")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		files := []string { "x", "a/y", "a/b/z", "q" }
+		for _, name := range files {
+			full := filepath.Join(root, filepath.FromSlash(name))
+			os.MkdirAll(filepath.Dir(full), 0755)
+			ioutil.WriteFile(full, []byte(name), 0644)
+		}
+		infos := make(chan CreateInfo)
+		result := make(chan CheckSet)
+		errs := make(chan *FileError)
+		go Create(root, infos, result, errs)
+		for _, name := range files {
+			full := filepath.Join(root, filepath.FromSlash(name))
+			infos <- CreateInfo { Name: full, Mode: 0644, Size: int64(len(name)), Target: AllPlatforms, BlockSize: 2 }
+		}
+		close(infos)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		Write(Meta{}, <-result, &buf)
+		outputs[i] = buf.Bytes()
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Error("checksets of identical trees differ")
+	}
+}
+
+func TestCreateSkipsUnreadable(t *testing.T) {
+	root, err := ioutil.TempDir("", "checkset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "there"), []byte("here"), 0644)
+	infos := make(chan CreateInfo)
+	result := make(chan CheckSet)
+	errs := make(chan *FileError)
+	go Create(root, infos, result, errs)
+	go func() {
+		for _, name := range []string { "gone", "there" } {
+			infos <- CreateInfo { Name: filepath.Join(root, name), Mode: 0644, Size: 4, Target: AllPlatforms }
+		}
+		close(infos)
+	}()
+	var failed []string
+	for err := range errs {
+		failed = append(failed, err.Name)
+	}
+	cset := <-result
+	if !reflect.DeepEqual(failed, []string { "gone" }) {
+		t.Errorf("failed files %v, want [gone]", failed)
+	}
+	if _, ok := cset["there"]; !ok || len(cset) != 1 {
+		t.Errorf("got checkset %v, want just there", SortedNames(cset))
+	}
+}
+
+func TestCreateRejectsBadLink(t *testing.T) {
+	root, err := ioutil.TempDir("", "checkset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	os.Symlink("../../etc", filepath.Join(root, "escape"))
+	infos := make(chan CreateInfo)
+	result := make(chan CheckSet)
+	errs := make(chan *FileError)
+	go Create(root, infos, result, errs)
+	go func() {
+		infos <- CreateInfo { Name: filepath.Join(root, "escape"), Mode: os.ModeSymlink | 0777, Target: AllPlatforms }
+		close(infos)
+	}()
+	var failed []*FileError
+	for err := range errs {
+		failed = append(failed, err)
+	}
+	<-result
+	if len(failed) != 1 || failed[0].Err != BadLink {
+		t.Errorf("got %v, want a bad link", failed)
+	}
+}
+
+func readHeader(t *testing.T, stream *bytes.Reader, header *CheckSetHeader) {
+	err := binary.Read(stream, binary.LittleEndian, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encodeTestCheckSet(t testing.TB) []byte {
+	meta, cset := testCheckSet()
+	var buf bytes.Buffer
+	err := Write(meta, cset, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writes entries as given, without the checks done by Writer
+func encodeRaw(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, CurrentVersionHeader)
+	WriteMeta(&buf, Meta{})
+	for _, name := range names {
+		pack, err := EncodeCheckPack(name, CheckInfo { AllPlatforms, 0644, HashLink(name), 0, "", 0, nil, nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		WriteCheckPack(&buf, pack)
+	}
+	return buf.Bytes()
+}
+
+// a checkset of one entry, written without the checks done by Writer
+func encodeRawInfo(t *testing.T, name string, info CheckInfo) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, CurrentVersionHeader)
+	WriteMeta(&buf, Meta{})
+	pack, err := EncodeCheckPack(name, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	WriteCheckPack(&buf, pack)
+	return buf.Bytes()
+}
+
+func parseError(t *testing.T, err error) *ParseError {
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got %v, want a ParseError", err)
+	}
+	return perr
+}
+
+// a newer writer's packs may have fields this reader doesn't know
+func TestReadNewerVersion(t *testing.T) {
+	var buf bytes.Buffer
+	header := CurrentVersionHeader
+	header.Version++
+	binary.Write(&buf, binary.LittleEndian, header)
+	WriteMeta(&buf, Meta{})
+	want := CheckInfo { AllPlatforms, os.ModeSymlink | 0777, HashLink("z"), 1, "z", 0, nil, nil }
+	pack, err := EncodeCheckPack("a", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := []uint8 { 1, 2, 3, 4 }
+	pack.Header.InfoLength += uint16(len(future))
+	pack.Info.FixedLength += uint16(len(future))
+	binary.Write(&buf, binary.LittleEndian, pack.Header)
+	buf.Write(pack.Name)
+	binary.Write(&buf, binary.LittleEndian, pack.Info)
+	buf.Write(future)
+	buf.Write(pack.Link)
+	_, cset, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cset["a"], want) {
+		t.Errorf("read %+v, wrote %+v", cset["a"], want)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	data := encodeRaw(t, "a", "b", "c")
+	_, _, err := Read(bytes.NewReader(data[:len(data) - 3]))
+	perr := parseError(t, err)
+	if perr.Record != 2 || perr.Err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want unexpected EOF in entry 2", perr)
+	}
+	whole := encodeRaw(t, "a", "b")
+	if perr.Offset != int64(len(whole)) {
+		t.Errorf("error at byte %d, entry starts at byte %d", perr.Offset, len(whole))
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	data := encodeRaw(t)
+	_, _, err := Read(bytes.NewReader(data[:3]))
+	if err != BadMagic {
+		t.Errorf("short header: got %v, want BadMagic", err)
+	}
+	_, _, err = Read(bytes.NewReader(data[:len(data) - 1]))
+	perr := parseError(t, err)
+	if perr.Record != -1 {
+		t.Errorf("short meta: got %v, want header error", perr)
+	}
+}
+
+func TestReadDuplicate(t *testing.T) {
+	_, _, err := Read(bytes.NewReader(encodeRaw(t, "a", "b", "b")))
+	perr := parseError(t, err)
+	if perr.Record != 2 || perr.Err != DuplicateName {
+		t.Errorf("got %v, want duplicate entry 2", perr)
+	}
+	_, _, err = Read(bytes.NewReader(encodeRaw(t, "b", "a")))
+	if parseError(t, err).Err != UnsortedName {
+		t.Errorf("got %v, want unsorted", err)
+	}
+}
+
+func TestReadBadNames(t *testing.T) {
+	for _, name := range []string { "", "/etc/passwd", "../x", "a/../../x", "a//b", ".", "..", "a\\b" } {
+		_, _, err := Read(bytes.NewReader(encodeRaw(t, name)))
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Err != BadName {
+			t.Errorf("%q: got %v, want bad name", name, err)
+		}
+	}
+}
+
+func TestReadBadLinks(t *testing.T) {
+	links := map[string]string {
+		"foo": "/etc",
+		"a/up": "../../x",
+		"back": "..\\x",
+		"drive": "C:x",
+		"empty": "",
+	}
+	for name, link := range links {
+		info := CheckInfo { AllPlatforms, os.ModeSymlink | 0777, HashLink(link), int64(len(link)), link, 0, nil, nil }
+		_, _, err := Read(bytes.NewReader(encodeRawInfo(t, name, info)))
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Err != BadLink {
+			t.Errorf("%s -> %s: got %v, want bad link", name, link, err)
+		}
+	}
+	for name, link := range map[string]string { "a/b/up": "../c", "a/same": ".", "deep": "x/y" } {
+		err := checkEntry(name, CheckInfo { AllPlatforms, os.ModeSymlink | 0777, HashLink(link), int64(len(link)), link, 0, nil, nil })
+		if err != nil {
+			t.Errorf("%s -> %s: got %v, want it accepted", name, link, err)
+		}
+	}
+}
+
+func TestReadLimits(t *testing.T) {
+	data := encodeRaw(t, "a", "b", "c")
+	limits := DefaultLimits
+	limits.MaxEntries = 2
+	reader, err := NewLimitedReader(bytes.NewReader(data), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _, err = reader.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, err = reader.Next()
+	if parseError(t, err).Err != TooManyEntries {
+		t.Errorf("got %v, want too many entries", err)
+	}
+	limits = DefaultLimits
+	limits.MaxNameLength = 3
+	reader, _ = NewLimitedReader(bytes.NewReader(encodeRaw(t, "abcd")), limits)
+	_, _, err = reader.Next()
+	if parseError(t, err).Err != NameTooLong {
+		t.Errorf("got %v, want name too long", err)
+	}
+}
+
+// what a Writer writes, a Reader with DefaultLimits reads
+func TestWriteLimits(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, Meta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", DefaultLimits.MaxNameLength + 1)
+	err = writer.Write(long, CheckInfo { AllPlatforms, 0644, HashLink(long), 0, "", 0, nil, nil })
+	if err != NameTooLong {
+		t.Errorf("got %v, want NameTooLong", err)
+	}
+	err = writer.Write(long[1:], CheckInfo { AllPlatforms, 0644, HashLink(long), 0, "", 0, nil, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cset, err := Read(&buf)
+	if err != nil || len(cset) != 1 {
+		t.Errorf("got %d entries and %v, want the one written", len(cset), err)
+	}
+}
+
+func TestReadCompressed(t *testing.T) {
+	var buf bytes.Buffer
+	compress, err := Compress(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compress.Write(encodeTestCheckSet(t))
+	compress.Close()
+	_, cset, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, want := testCheckSet()
+	if len(cset) != len(want) {
+		t.Errorf("read %d entries, want %d", len(cset), len(want))
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	data := encodeTestCheckSet(t)
+	var buf bytes.Buffer
+	compress, err := Compress(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compress.Write(data)
+	compress.Close()
+	if bytes.Equal(buf.Bytes(), data) || !bytes.HasPrefix(buf.Bytes(), gzipMagic) {
+		t.Fatal("compressed checkset isn't gzipped")
+	}
+	for _, stream := range [][]byte { buf.Bytes(), data } {
+		read, err := Decompress(bytes.NewReader(stream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("decompressed checkset differs from the original")
+		}
+	}
+}
+
+func FuzzRead(f *testing.F) {
+	f.Add(encodeTestCheckSet(f))
+	f.Add([]byte("RSPCHECK"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		meta, cset, err := Read(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// whatever was read must survive a round trip
+		var buf bytes.Buffer
+		err = Write(meta, cset, &buf)
+		if err != nil {
+			t.Fatalf("can't write what was read: %v", err)
+		}
+		_, again, err := Read(&buf)
+		if err != nil {
+			t.Fatalf("can't read what was written: %v", err)
+		}
+		if len(again) != len(cset) {
+			t.Fatalf("read %d entries back, wrote %d", len(again), len(cset))
+		}
+		for name, info := range cset {
+			if !reflect.DeepEqual(again[name], info) {
+				t.Fatalf("%s: read back %+v, wrote %+v", name, again[name], info)
+			}
+		}
+	})
+}
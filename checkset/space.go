@@ -0,0 +1,61 @@
+// space.go - how much disk an update will take
+
+package checkset
+
+import (
+	"os"
+)
+
+// bytes that resolving bad files would add to the disk, totalled as
+// they are found.
+// files replaced in place only need the difference in size, but room
+// is also left for the largest file, as patches and downloads into a
+// store build a whole new copy before replacing the old one.
+type Space struct {
+	total int64
+	largest int64
+}
+
+// count bad. size is asked for the size of files whose entries don't
+// record it.
+func (space *Space) Add(bad BadFile, size func(BadFile) (int64, error)) error {
+	if bad.Reason == PermMismatch || bad.Info.Mode & os.ModeType != 0 {
+		return nil
+	}
+	want := bad.Info.Size
+	if want == UnknownSize {
+		var err error
+		want, err = size(bad)
+		if err != nil {
+			return err
+		}
+	}
+	if want > space.largest {
+		space.largest = want
+	}
+	var have int64
+	fi, err := os.Lstat(bad.Local)
+	if err == nil && fi.Mode().IsRegular() {
+		have = fi.Size()
+	}
+	if want > have {
+		space.total += want - have
+	}
+	return nil
+}
+
+func (space Space) Needed() int64 {
+	return space.total + space.largest
+}
+
+// the Space needed by bads
+func SpaceNeeded(bads []BadFile, size func(BadFile) (int64, error)) (int64, error) {
+	var space Space
+	for _, bad := range bads {
+		err := space.Add(bad, size)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return space.Needed(), nil
+}
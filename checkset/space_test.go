@@ -0,0 +1,64 @@
+package checkset
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpaceAdd(t *testing.T) {
+	root := tempDir(t)
+	os.WriteFile(filepath.Join(root, "short"), []byte("1234"), 0644)
+	os.WriteFile(filepath.Join(root, "long"), []byte("123456789012"), 0644)
+	bad := func(name string, size int64, reason int) BadFile {
+		info := CheckInfo { AllPlatforms, 0644, [HashSize]byte{}, size, "", 0, nil, nil }
+		return BadFile { name, filepath.Join(root, name), info, reason, nil }
+	}
+	asked := 0
+	size := func(bad BadFile) (int64, error) {
+		asked++
+		return 7, nil
+	}
+	dir := bad("dir", 0, Missing)
+	dir.Info.Mode = os.ModeDir | 0755
+	tests := []struct {
+		bad BadFile
+		total int64 // added to the total
+		largest int64
+	} {
+		{ bad("missing", 10, Missing), 10, 10 },
+		{ bad("short", 10, HashMismatch), 6, 10 }, // replaced in place, so only the difference
+		{ bad("long", 10, HashMismatch), 0, 10 }, // shrinks
+		{ bad("short", 100, PermMismatch), 0, 10 }, // nothing to fetch
+		{ dir, 0, 10 },
+		{ bad("unknown", UnknownSize, Missing), 7, 10 }, // asks size
+		{ bad("long", 20, HashMismatch), 8, 20 },
+	}
+	var space Space
+	var total int64
+	var bads []BadFile
+	for i, test := range tests {
+		err := space.Add(test.bad, size)
+		total += test.total
+		if err != nil || space.total != total || space.largest != test.largest {
+			t.Errorf("%d: got %+v, %v; want total %d, largest %d", i, space, err, total, test.largest)
+		}
+		bads = append(bads, test.bad)
+	}
+	if asked != 1 {
+		t.Errorf("asked the size %d times, want once for the file of unknown size", asked)
+	}
+	if space.Needed() != total + 20 {
+		t.Errorf("need %d, want room for the largest file too", space.Needed())
+	}
+	needed, err := SpaceNeeded(bads, size)
+	if err != nil || needed != space.Needed() {
+		t.Errorf("SpaceNeeded gave %d, %v; want %d", needed, err, space.Needed())
+	}
+	failure := errors.New("no HEAD")
+	_, err = SpaceNeeded(bads, func(BadFile) (int64, error) { return 0, failure })
+	if err != failure {
+		t.Errorf("got %v when sizes can't be found", err)
+	}
+}
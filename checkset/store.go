@@ -0,0 +1,107 @@
+// store.go - local store keeping one copy of each file, shared by links
+
+package checkset
+
+import (
+	"context"
+	"errors"
+	"github.com/rspeele/check-update/futility"
+	"os"
+	"path/filepath"
+)
+
+// directory holding files by hash, laid out like a content-addressed
+// server. installed files are hardlinks to the files in it, or copies
+// where links can't be made.
+type Store string
+
+var StoreCorrupt = errors.New("file fetched into store differs from expected")
+
+func (store Store) Path(hash [HashSize]byte) string {
+	return filepath.Join(string(store), filepath.FromSlash(ObjectPath(hash)))
+}
+
+// objects are only put in place once verified, so checking the size is
+// enough to tell a complete one. but an installed file is a link to its
+// object, so changing the file changes the object; see Intact.
+func (store Store) Has(info CheckInfo) bool {
+	fi, err := os.Stat(store.Path(info.Hash))
+	return err == nil && fi.Mode().IsRegular() &&
+		(info.Size == UnknownSize || fi.Size() == info.Size)
+}
+
+// whether the store has the object for info and it still matches
+func (store Store) Intact(info CheckInfo) bool {
+	return store.Has(info) && CheckHash(store.Path(info.Hash), info.Hash)
+}
+
+// link or copy from to a temporary name next to to, then move it over to
+func linkOrCopy(from, to string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	temp := to + ".link"
+	os.Remove(temp)
+	if os.Link(from, temp) != nil {
+		err = futility.CopyFile(from, temp, mode)
+		if err != nil {
+			os.Remove(temp)
+			return err
+		}
+	}
+	return futility.Replace(temp, to)
+}
+
+// download the file described by info into the store
+func (store Store) Fetch(ctx context.Context, info CheckInfo, remote string, get Retriever) error {
+	object := store.Path(info.Hash)
+	fetched := object + ".fetched"
+	err := installFile(ctx, fetched, info, remote, get)
+	if err == nil && !CheckHash(fetched, info.Hash) {
+		err = StoreCorrupt
+	}
+	if err != nil {
+		os.Remove(fetched)
+		return err
+	}
+	return futility.Replace(fetched, object)
+}
+
+// add the verified file at local to the store
+func (store Store) Adopt(local string, info CheckInfo) error {
+	return linkOrCopy(local, store.Path(info.Hash), info.Mode & permBits)
+}
+
+// make the file at local the store's copy of the file described by info
+func (store Store) Materialize(local string, info CheckInfo) error {
+	object := store.Path(info.Hash)
+	want := info.Mode & permBits
+	fi, err := os.Stat(object)
+	if err != nil {
+		return err
+	}
+	// links share permissions, so the object needs those of every
+	// install of it
+	if fi.Mode() & want != want {
+		os.Chmod(object, fi.Mode() & permBits | want)
+	}
+	return linkOrCopy(object, local, want)
+}
+
+func installStored(ctx context.Context, local string, info CheckInfo, remote string, src Source) error {
+	store := src.Store
+	// the file is only being installed because it is missing or bad,
+	// and if it was bad, so may be the object it is linked to
+	if !store.Intact(info) {
+		if CanPatch(info) && Patch(ctx, local, info, src.Get) == nil {
+			store.Adopt(local, info) // local is fine either way
+			return nil
+		}
+		err := store.Fetch(ctx, info, remote, src.Get)
+		if err != nil {
+			return err
+		}
+	}
+	return store.Materialize(local, info)
+}
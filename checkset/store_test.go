@@ -0,0 +1,118 @@
+package checkset
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fileInfo(content string) CheckInfo {
+	return CheckInfo { AllPlatforms, 0644, HashLink(content), int64(len(content)), "", 0, nil, nil }
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "checkset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func readFile(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStoreFetch(t *testing.T) {
+	store := Store(tempDir(t))
+	info := fileInfo("content")
+	src := stringSource(map[string]string { "good": "content", "bad": "tampered" })
+	err := store.Fetch(context.Background(), info, "bad", src.Get)
+	if err != StoreCorrupt {
+		t.Errorf("got %v, want StoreCorrupt", err)
+	}
+	if store.Has(info) {
+		t.Error("store has an object that didn't match")
+	}
+	err = store.Fetch(context.Background(), info, "good", src.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Intact(info) || readFile(t, store.Path(info.Hash)) != "content" {
+		t.Error("fetched object isn't in the store")
+	}
+}
+
+func TestStoreAdoptMaterialize(t *testing.T) {
+	store := Store(tempDir(t))
+	dir := tempDir(t)
+	info := fileInfo("content")
+	first := filepath.Join(dir, "first")
+	ioutil.WriteFile(first, []byte("content"), 0644)
+	err := store.Adopt(first, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Intact(info) {
+		t.Fatal("adopted file isn't in the store")
+	}
+	info.Mode = 0755
+	second := filepath.Join(dir, "sub", "second")
+	err = store.Materialize(second, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, second) != "content" {
+		t.Error("materialized file differs from the object")
+	}
+	fi, err := os.Stat(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() & 0755 != 0755 {
+		t.Errorf("materialized with mode %v, want at least 0755", fi.Mode())
+	}
+}
+
+// editing an installed file corrupts the object it is linked to, which
+// must not then be linked again
+func TestStoreRecoversCorruption(t *testing.T) {
+	store := Store(tempDir(t))
+	root := tempDir(t)
+	info := fileInfo("content")
+	src := stringSource(map[string]string { "file": "content" })
+	src.Store = store
+	bad := BadFile { Remote: "file", Info: info, Reason: Missing }
+	err := Resolve(context.Background(), root, bad, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(root, "file")
+	// in place, as an editor might
+	file, err := os.OpenFile(local, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("CONTENT"), 0)
+	file.Close()
+	if store.Intact(info) {
+		t.Skip("installed file isn't linked to the store here")
+	}
+	bad.Reason = HashMismatch
+	err = Resolve(context.Background(), root, bad, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readFile(t, local) != "content" {
+		t.Errorf("file is %q after resolving", readFile(t, local))
+	}
+	if !store.Intact(info) {
+		t.Error("store object is still corrupt")
+	}
+}
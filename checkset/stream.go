@@ -0,0 +1,270 @@
+// stream.go - reading and writing CheckSets one entry at a time
+
+package checkset
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+type Entry struct {
+	Name string
+	Info CheckInfo
+}
+
+// bounds on what a Reader will accept, so that a corrupt or hostile
+// checkset can't make it allocate without limit
+type Limits struct {
+	MaxEntries int
+	MaxNameLength int
+	MaxInfoLength int
+	MaxMetaLength int // total length of all keys and values
+	MaxBlockSize int64
+}
+
+var DefaultLimits = Limits {
+	MaxEntries: 1<<22,
+	MaxNameLength: 1024,
+	MaxInfoLength: 0xffff,
+	MaxMetaLength: 1<<20,
+	MaxBlockSize: 1<<30,
+}
+
+var TooManyEntries = errors.New("too many entries")
+var NameTooLong = errors.New("name too long")
+var InfoTooLong = errors.New("entry info too long")
+var BadName = errors.New("name is not a clean relative path")
+var BadLink = errors.New("symlink target leaves the directory it is installed to")
+var DuplicateName = errors.New("duplicate name")
+var UnsortedName = errors.New("name out of order")
+
+// where in a checkset it stopped making sense
+type ParseError struct {
+	Offset int64 // in the uncompressed checkset
+	Record int // index of the entry, or -1 for the header and Meta
+	Err error
+}
+
+func (err *ParseError) Error() string {
+	if err.Record < 0 {
+		return fmt.Sprintf("bad checkset header at byte %d: %v", err.Offset, err.Err)
+	}
+	return fmt.Sprintf("bad checkset entry %d at byte %d: %v", err.Record, err.Offset, err.Err)
+}
+
+func (err *ParseError) Unwrap() error {
+	return err.Err
+}
+
+// counts bytes read through it
+type countingReader struct {
+	stream io.Reader
+	count int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.stream.Read(p)
+	counter.count += int64(n)
+	return n, err
+}
+
+// whether name can be the name of an entry
+func ValidName(name string) bool {
+	return checkName(name) == nil
+}
+
+// names must stay inside the directory they are installed to
+func checkName(name string) error {
+	if name == "" || name == "." || path.Clean(name) != name || path.IsAbs(name) ||
+		name == ".." || strings.HasPrefix(name, "../") ||
+		strings.Contains(name, "\\") {
+		return BadName
+	}
+	return nil
+}
+
+// symlinks must point inside the directory they are installed to, as
+// their names must be. Windows drive letters count as absolute.
+func checkLink(name, link string) error {
+	if link == "" || path.IsAbs(link) || strings.Contains(link, "\\") ||
+		len(link) >= 2 && link[1] == ':' {
+		return BadLink
+	}
+	target := path.Join(path.Dir(name), link)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return BadLink
+	}
+	return nil
+}
+
+// checkName, and checkLink if info is a symlink
+func checkEntry(name string, info CheckInfo) error {
+	err := checkName(name)
+	if err == nil && info.Mode & os.ModeSymlink != 0 {
+		err = checkLink(name, info.Link)
+	}
+	return err
+}
+
+// decodes entries as they arrive, without holding the whole CheckSet
+type Reader struct {
+	Meta Meta
+	Version uint16
+	Limits Limits
+	stream *countingReader
+	entries int
+	last string
+	seen map[string]bool // names from before entries were sorted
+}
+
+// read the header and Meta from stream, which may be compressed
+func NewReader(stream io.Reader) (*Reader, error) {
+	return NewLimitedReader(stream, DefaultLimits)
+}
+
+func NewLimitedReader(stream io.Reader, limits Limits) (*Reader, error) {
+	var version CheckSetHeader
+	reader := &Reader { Limits: limits }
+	stream, err := Decompress(stream)
+	if err != nil {
+		return reader, err
+	}
+	reader.stream = &countingReader { stream, 0 }
+	fail := func(err error) (*Reader, error) {
+		if err == BadMagic {
+			return reader, err
+		}
+		return reader, &ParseError { reader.stream.count, -1, truncated(err) }
+	}
+	err = binary.Read(reader.stream, binary.LittleEndian, &version)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fail(BadMagic) // too short to be a checkset at all
+		}
+		return fail(err)
+	}
+	// newer versions are read as far as this reader understands them.
+	// their packs only add fields, which are skipped; a release that
+	// can't be handled without them says so with Meta.MinUpdater.
+	if version.Magic != CurrentVersionHeader.Magic {
+		return fail(BadMagic)
+	}
+	reader.Version = version.Version
+	if version.Version < 4 {
+		reader.seen = make(map[string]bool)
+	}
+	if version.Version >= 1 {
+		reader.Meta, err = readMeta(reader.stream, limits)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	return reader, nil
+}
+
+func (reader *Reader) checkOrder(name string) error {
+	if reader.seen != nil {
+		if reader.seen[name] {
+			return DuplicateName
+		}
+		reader.seen[name] = true
+	} else if reader.entries > 0 && name <= reader.last {
+		if name == reader.last {
+			return DuplicateName
+		}
+		return UnsortedName
+	}
+	reader.last = name
+	return nil
+}
+
+// returns io.EOF after the last entry, or a *ParseError
+func (reader *Reader) Next() (string, CheckInfo, error) {
+	offset := reader.stream.count
+	fail := func(err error) (string, CheckInfo, error) {
+		return "", CheckInfo{}, &ParseError { offset, reader.entries, err }
+	}
+	pack, err := readCheckPack(reader.stream, reader.Limits)
+	if err == io.EOF {
+		return "", CheckInfo{}, err
+	} else if err != nil {
+		return fail(err)
+	}
+	if reader.entries >= reader.Limits.MaxEntries {
+		return fail(TooManyEntries)
+	}
+	name, info := decodeCheckPack(&pack, reader.Version)
+	err = checkEntry(name, info)
+	if err == nil {
+		err = reader.checkOrder(name)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	reader.entries++
+	return name, info, nil
+}
+
+// send every remaining entry to entries, then close it. stops early
+// with ctx.Err() when ctx is done.
+func (reader *Reader) Send(ctx context.Context, entries chan Entry) error {
+	defer close(entries)
+	for {
+		name, info, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		select {
+		case entries <- Entry { name, info }:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// encodes entries, which must be given in sorted order, refusing any
+// a Reader with DefaultLimits would
+type Writer struct {
+	stream io.Writer
+	last string
+	entries int
+}
+
+// write the header and Meta to stream
+func NewWriter(stream io.Writer, meta Meta) (*Writer, error) {
+	err := binary.Write(stream, binary.LittleEndian, CurrentVersionHeader)
+	if err != nil {
+		return nil, err
+	}
+	err = WriteMeta(stream, meta)
+	return &Writer { stream, "", 0 }, err
+}
+
+func (writer *Writer) Write(name string, info CheckInfo) error {
+	err := checkEntry(name, info)
+	if err != nil {
+		return err
+	}
+	if len(name) > DefaultLimits.MaxNameLength {
+		return NameTooLong
+	} else if writer.entries >= DefaultLimits.MaxEntries {
+		return TooManyEntries
+	} else if writer.entries > 0 && name <= writer.last {
+		return UnsortedName
+	}
+	pack, err := EncodeCheckPack(name, info)
+	if err != nil {
+		return err
+	}
+	writer.last = name
+	writer.entries++
+	return WriteCheckPack(writer.stream, pack)
+}
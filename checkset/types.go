@@ -5,21 +5,30 @@ package checkset
 import (
 	"fmt"
 	"os"
+	"sort"
 )
 
-type OperatingSystem uint8
+type OperatingSystem uint32
 const (
-	Unix = 1<<iota
+	Linux = 1<<iota
+	Darwin
+	FreeBSD
+	OpenBSD
 	Windows
-	AllOSes = 0xff
+	OtherUnix // unix-like OSes without a bit of their own
+	Unix = Linux | Darwin | FreeBSD | OpenBSD | OtherUnix
+	AllOSes = 0xffffffff
 )
 
-type Architecture uint8
+type Architecture uint32
 const (
 	I386 = 1<<iota
 	AMD64
 	ARM
-	AllArches = 0xff
+	ARM64
+	RISCV64
+	PPC64LE
+	AllArches = 0xffffffff
 )
 
 type Platform struct {
@@ -32,16 +41,40 @@ var AllPlatforms = Platform {
 	AllArches,
 }
 
+// Size of files listed by checksets too old to record it
+const UnknownSize = -1
+
+// symlinks and empty directories are listed along with regular files,
+// told apart by the type bits of Mode. a symlink's Hash and Size are
+// those of its target path; a directory's are zero.
+// large files may also list the hash of each BlockSize chunk, so that
+// only the chunks that differ need to be fetched, and the hashes of
+// older versions there are patches from.
 type CheckInfo struct {
 	Target Platform
 	Mode os.FileMode
 	Hash [HashSize]byte
+	Size int64
+	Link string // symlink target
+	BlockSize int64
+	Blocks [][HashSize]byte
+	Bases [][HashSize]byte
 }
 
 type CheckSet map[string] CheckInfo
 
+func SortedNames(cset CheckSet) []string {
+	names := make([]string, 0, len(cset))
+	for name := range cset {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func Show(cset CheckSet) {
-	for k, v := range cset {
-		fmt.Printf("%-30s %000o %x\n", k, v.Mode, v.Hash)
+	for _, k := range SortedNames(cset) {
+		v := cset[k]
+		fmt.Printf("%-30s %000o %10d %x\n", k, v.Mode, v.Size, v.Hash)
 	}
 }
\ No newline at end of file
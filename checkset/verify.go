@@ -3,6 +3,7 @@
 package checkset
 
 import (
+	"context"
 	"path"
 	"os"
 )
@@ -14,6 +15,7 @@ const (
 	HashMismatch
 	TypeMismatch
 	PermMismatch
+	Unreadable // couldn't tell; see BadFile.Err
 )
 
 type BadFile struct {
@@ -21,40 +23,128 @@ type BadFile struct {
 	Local string
 	Info CheckInfo
 	Reason int
+	Err error // why the file couldn't be checked, if it couldn't
 }
 
-func TestFile(local string, info CheckInfo) int {
-	fi, err := os.Lstat(local)
+// mode bits compared when checking permissions
+const permBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// hash the file at local, giving up once ctx is done
+func hashFile(ctx context.Context, local string) ([HashSize]byte, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return [HashSize]byte{}, err
+	}
+	defer file.Close()
+	return HashReader(&contextReader { ctx, file })
+}
+
+func testContent(ctx context.Context, local string, fi os.FileInfo, info CheckInfo) (int, error) {
 	switch {
-	case err != nil:
-		return Missing
-	case fi.Mode() & os.ModeType != 0:
-		return TypeMismatch
-	case !CheckHash(local, info.Hash):
-		return HashMismatch
-	case fi.Mode() & info.Mode != info.Mode:
-		return PermMismatch
+	case info.Mode & os.ModeSymlink != 0:
+		target, err := os.Readlink(local)
+		if err != nil {
+			return Unreadable, err
+		} else if target != info.Link {
+			return HashMismatch, nil
+		}
+	case info.Mode.IsDir():
+	case info.Size != UnknownSize && fi.Size() != info.Size:
+		return HashMismatch, nil // cheaper than hashing to find out
+	default:
+		hash, err := hashFile(ctx, local)
+		if err != nil {
+			return Unreadable, err
+		} else if hash != info.Hash {
+			return HashMismatch, nil
+		}
 	}
-	return Valid
+	return Valid, nil
 }
 
-// send file paths failing verification to failed
-func Verify(root string, cset CheckSet, failed chan BadFile) {
+// returns the reason local doesn't match info, or Valid. the error is
+// only set for Unreadable, which is also the reason if ctx is done
+// before the file is hashed.
+func CheckFile(ctx context.Context, local string, info CheckInfo) (int, error) {
+	fi, err := os.Lstat(local)
+	if os.IsNotExist(err) {
+		return Missing, nil
+	} else if err != nil {
+		return Unreadable, err
+	}
+	if fi.Mode() & os.ModeType != info.Mode & os.ModeType {
+		return TypeMismatch, nil
+	}
+	if reason, err := testContent(ctx, local, fi, info); reason != Valid {
+		return reason, err
+	}
+	want := info.Mode & permBits
+	if info.Mode & os.ModeSymlink == 0 && fi.Mode() & want != want {
+		return PermMismatch, nil // symlinks have no permissions of their own
+	}
+	return Valid, nil
+}
+
+func TestFile(local string, info CheckInfo) int {
+	reason, _ := CheckFile(context.Background(), local, info)
+	return reason
+}
+
+// send entries failing verification to failed, until entries is closed
+// or ctx is done
+func VerifyEntries(ctx context.Context, root string, entries chan Entry, failed chan BadFile, tracker *Tracker) {
+	defer close(failed)
 	platform := CurrentPlatform()
-	for file, info := range cset {
+	for {
+		var entry Entry
+		var ok bool
+		select {
+		case entry, ok = <-entries:
+		case <-ctx.Done():
+			return
+		}
+		if !ok {
+			return
+		}
+		file, info := entry.Name, entry.Info
 		if !MatchPlatform(platform, info.Target) {
 			continue // skip files not targeted for this platform
 		}
 		local := path.Join(root, file)
-		reason := TestFile(local, info)
+		reason, err := CheckFile(ctx, local, info)
+		if ctx.Err() != nil {
+			return // the file may not have been checked
+		}
+		tracker.Checked()
 		if reason > Valid {
-			failed <- BadFile {
+			bad := BadFile {
 				file,
 				local,
 				info,
 				reason,
+				err,
+			}
+			select {
+			case failed <- bad:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}
-	close(failed)
-}
\ No newline at end of file
+}
+
+// send file paths failing verification to failed
+func Verify(ctx context.Context, root string, cset CheckSet, failed chan BadFile, tracker *Tracker) {
+	entries := make(chan Entry)
+	go func() {
+		defer close(entries)
+		for file, info := range cset {
+			select {
+			case entries <- Entry { file, info }:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	VerifyEntries(ctx, root, entries, failed, tracker)
+}
@@ -0,0 +1,37 @@
+package checkset
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckFile(t *testing.T) {
+	name := tempFile(t, "content")
+	reason, err := CheckFile(context.Background(), name, fileInfo("content"))
+	if reason != Valid || err != nil {
+		t.Errorf("got %d, %v for a good file", reason, err)
+	}
+	reason, _ = CheckFile(context.Background(), name, fileInfo("altered"))
+	if reason != HashMismatch {
+		t.Errorf("got %d for a changed file", reason)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reason, err = CheckFile(ctx, name, fileInfo("content"))
+	if reason != Unreadable || err != context.Canceled {
+		t.Errorf("got %d, %v once cancelled", reason, err)
+	}
+}
+
+func TestVerifyCancelled(t *testing.T) {
+	name := tempFile(t, "content")
+	cset := CheckSet { filepath.Base(name): fileInfo("content") }
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failed := make(chan BadFile)
+	go Verify(ctx, filepath.Dir(name), cset, failed, nil)
+	for bad := range failed {
+		t.Errorf("%s reported bad after cancelling", bad.Remote)
+	}
+}
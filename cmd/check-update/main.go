@@ -1,18 +1,22 @@
 package main
 
 import (
-	"./checkset"
-	"./futility"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/rspeele/check-update/checkset"
+	"github.com/rspeele/check-update/futility"
+	"github.com/rspeele/check-update/updater"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -24,71 +28,49 @@ func EnvValue(env string) string {
 	return split[1]
 }
 
-func GetHTTP(url string) (io.ReadCloser, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	} else if resp.StatusCode != http.StatusOK {
-		// accept no HTTP errors
-		resp.Body.Close()
-		return nil, errors.New(resp.Status)
-	}
-	return resp.Body, err
-}
-
-func GetFrom(base string) checkset.Retriever {
-	return func(name string) (io.ReadCloser, error) {
-		return GetHTTP(base + name)
-	}
-}
-
-func DescribeReason(reason int) string {
-	switch reason {
-	case checkset.Valid:
-		return "valid (this is a bug, but probably harmless)"
-	case checkset.Missing:
-		return "missing"
-	case checkset.HashMismatch:
-		return "outdated"
-	case checkset.TypeMismatch:
-		return "wrong file type"
-	case checkset.PermMismatch:
-		return "permissions"
-	}
-	return "unknown reason (this is a bug)"
+// parse a rate like 500000, 500K or 2M into bytes per second
+func ParseRate(rate string) (int64, error) {
+	scale := int64(1)
+	switch {
+	case strings.HasSuffix(strings.ToUpper(rate), "K"):
+		scale = 1024
+	case strings.HasSuffix(strings.ToUpper(rate), "M"):
+		scale = 1024*1024
+	}
+	digits := rate
+	if scale != 1 {
+		digits = rate[:len(rate) - 1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("bad rate " + rate)
+	}
+	return n * scale, nil
 }
 
-func ShowBad(in chan checkset.BadFile, count *int, out chan checkset.BadFile) {
-	*count = 0
-	for bad := range in {
-		why := DescribeReason(bad.Reason)
-		log.Printf("%-40s %s", bad.Remote, why)
-		out <- bad
-		*count++
-	}
-	close(out)
-}
+// shared by all downloads; nil if they aren't limited
+var Limit *futility.Limiter
 
-func Update(source, update, local string) (int, error) {
-	log.Printf("downloading checkset %s", update)
-	stream, err := GetFrom(source)(update)
-	if err != nil {
-		return 0, err
-	}
-	cset, err := checkset.Read(stream)
-	if err != nil {
-		return 0, err
-	}
-	log.Printf("verifying %d files in %s", len(cset), local)
-	bad := make(chan checkset.BadFile)
-	pipe := make(chan checkset.BadFile)
-	erc := make(chan error)
-	var count int
-	go checkset.Verify(local, cset, bad)
-	go ShowBad(bad, &count, pipe)
-	go checkset.Apply(local, GetFrom(source), pipe, erc)
-	for err = range erc {
-		log.Print(err)
+// bring local up to date with the release at base, returning how many
+// files were updated. files that fail are tried once more, in case it
+// was the network's fault.
+func Update(ctx context.Context, base, update, local string, store checkset.Store) (int, error) {
+	server := updater.HTTP { Base: base, Limit: Limit }
+	defer Bar.Clear()
+	opts := updater.Options {
+		Source: server.Source(),
+		CheckSet: update,
+		Local: local,
+		Store: store,
+		Size: server.Size,
+		Logger: log.Default(),
+		Progress: Bar.Show,
+	}
+	result, err := updater.Update(ctx, opts)
+	count := result.Updated()
+	if err != nil && ctx.Err() == nil && result.Err() != nil {
+		result, err = updater.Retry(ctx, opts, result)
+		count += result.Updated()
 	}
 	return count, err
 }
@@ -120,29 +102,14 @@ func FindSauerbraten() string {
 	return ""
 }
 
-type ProgressWriter struct {
-	written int
-	lastShown int
-}
-
-func(writer *ProgressWriter) Write(p []byte) (n int, err error) {
-	const MB = 1024*1024
-	writer.written += len(p)
-	if writer.written > writer.lastShown + MB * 5 {
-		writer.lastShown = writer.written
-		log.Printf("downloaded %d MB", writer.written / MB)
-	}
-	return len(p), nil
-}
-
-func GetSauerbraten() error {
+func GetSauerbraten(ctx context.Context) error {
 	const InstallerPath = "Sauerbraten_Installer.exe"
 	var err error
 	if _, err = os.Stat(InstallerPath); os.IsNotExist(err) {
 		log.Print("downloading Sauerbraten installer, this may take a while")
 		timestamp := time.Now().Unix() * 1000
-		url := fmt.Sprintf("http://downloads.sourceforge.net/project/sauerbraten/sauerbraten/2013_01_04/sauerbraten_2013_02_03_collect_edition_windows.exe?r=http%3A%2F%2Fsauerbraten.org%2F&ts=%d&use_mirror=iweb", timestamp)
-		stream, err := GetHTTP(url)
+		url := fmt.Sprintf("http://downloads.sourceforge.net/project/sauerbraten/sauerbraten/2013_01_04/sauerbraten_2013_02_03_collect_edition_windows.exe?r=http%%3A%%2F%%2Fsauerbraten.org%%2F&ts=%d&use_mirror=iweb", timestamp)
+		stream, err := updater.HTTP { Limit: Limit }.Get(ctx, url)
 		if err != nil {
 			log.Print("failed to download Sauerbraten installer")
 			return err
@@ -155,12 +122,13 @@ func GetSauerbraten() error {
 			log.Print("failed to create Sauerbraten installer file")
 			return err
 		}
-		progress := ProgressWriter{ written:0, lastShown:0 }
-		writer := io.MultiWriter(output, &progress)
-		_, err = io.Copy(writer, stream)
+		tracker := checkset.NewTracker(Bar.Show)
+		_, err = io.Copy(output, tracker.Reader(stream))
+		Bar.Clear()
 		if err != nil {
 			log.Print("failed to write installer data")
 			output.Close()
+			os.Remove(InstallerPath + ".part")
 			return err
 		}
 		output.Close()
@@ -192,16 +160,36 @@ func main() {
 	var count int
 	var sauer string
 	meta := flag.Bool("meta", true, "update the updater")
+	store := flag.String("store", "", "keep one copy of each file in this directory and link installs to it")
+	limit := flag.String("limit", os.Getenv("CHECK_UPDATE_LIMIT"),
+		"limit downloads to this many bytes per second, e.g. 500K or 2M; defaults to $CHECK_UPDATE_LIMIT")
 	flag.Parse()
+	log.SetOutput(Bar)
+	// on the first interrupt, stop cleanly. on the next, just die.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if *limit != "" {
+		rate, err := ParseRate(*limit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rate > 0 {
+			Limit = futility.NewLimiter(rate)
+		}
+	}
 	os.Remove(os.Args[0] + ".trash")
 	if *meta {
-		count, err = Update("http://toastermod.com/updates/meta/", "meta.chk", path.Dir(os.Args[0]))
+		count, err = Update(ctx, "http://toastermod.com/updates/meta/", "meta.chk", path.Dir(os.Args[0]), "")
 		if err != nil {
 			goto end
 		}
 		if count > 0 {
 			// re-launch self
-			cmd := exec.Command(os.Args[0])
+			cmd := exec.Command(os.Args[0], os.Args[1:]...)
 			cmd.Stdin = os.Stdin
 			stdout, _ := cmd.StdoutPipe()
 			stderr, _ := cmd.StderrPipe()
@@ -214,20 +202,23 @@ func main() {
 	sauer = FindSauerbraten()
 	if sauer == "" {
 		log.Print("you do not appear to have Sauerbraten installed")
-		err = GetSauerbraten()
+		err = GetSauerbraten(ctx)
 		if err != nil {
 			goto end
 		}
 		sauer = FindSauerbraten()
 	}
-	count, err = Update("http://toastermod.com/updates/toastermod/", "toastermod.chk", "toastermod")
+	count, err = Update(ctx, "http://toastermod.com/updates/toastermod/", "toastermod.chk", "toastermod", checkset.Store(*store))
 	if err != nil {
 		goto end
 	}
-	log.Printf("%d files required updates", count)
+	log.Printf("%d files were updated", count)
 	err = RunGame(sauer)
 end:
-	if err != nil {
+	if ctx.Err() != nil {
+		log.Print("interrupted; your installation is incomplete")
+		os.Exit(1)
+	} else if err != nil {
 		log.Print(err)
 		log.Print("your installation is incomplete")
 		println("--- press return to exit ---")
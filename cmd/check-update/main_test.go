@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	good := map[string]int64 { "500000": 500000, "500K": 500 * 1024, "2m": 2 * 1024 * 1024, "0": 0 }
+	for rate, want := range good {
+		got, err := ParseRate(rate)
+		if err != nil || got != want {
+			t.Errorf("%s: got %d, %v; want %d", rate, got, err, want)
+		}
+	}
+	for _, rate := range []string { "2xM", "-1K", "", "K" } {
+		_, err := ParseRate(rate)
+		if err == nil || err.Error() != "bad rate " + rate {
+			t.Errorf("%s: got %v, want it named in the error", rate, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// progress.go - drawing a progress bar on the terminal
+
+package main
+
+import (
+	"fmt"
+	"github.com/rspeele/check-update/checkset"
+	"github.com/rspeele/check-update/updater"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// draws progress on the last line of a terminal, keeping log output
+// from running into it. when not writing to a terminal, just logs
+// every few MB downloaded instead.
+type ProgressBar struct {
+	lock sync.Mutex
+	out *os.File
+	terminal bool
+	line string
+	drawn time.Time
+	logged int64
+}
+
+func NewProgressBar(out *os.File) *ProgressBar {
+	fi, err := out.Stat()
+	terminal := err == nil && fi.Mode() & os.ModeCharDevice != 0
+	return &ProgressBar { out: out, terminal: terminal }
+}
+
+func FormatETA(eta time.Duration) string {
+	if eta < 0 {
+		return "--:--"
+	}
+	secs := int64(eta / time.Second)
+	return fmt.Sprintf("%d:%02d", secs / 60, secs % 60)
+}
+
+func RenderProgress(p checkset.Progress) string {
+	const width = 20
+	if p.Bytes == 0 && p.File == "" {
+		return fmt.Sprintf("checked %d files, %d to update", p.Checked, p.Remaining)
+	}
+	filled := 0
+	if p.Total > 0 {
+		filled = int(int64(width) * p.Bytes / p.Total)
+		if filled > width {
+			filled = width
+		}
+	}
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", width - filled)
+	return fmt.Sprintf("[%s] %d left  %s / %s  %s/s  ETA %s  %s", bar, p.Remaining,
+		updater.FormatSize(p.Bytes), updater.FormatSize(p.Total), updater.FormatSize(int64(p.Rate)), FormatETA(p.ETA), p.File)
+}
+
+// erase the bar; call with lock held
+func (bar *ProgressBar) erase() {
+	if bar.line != "" {
+		fmt.Fprintf(bar.out, "\r%s\r", strings.Repeat(" ", len(bar.line)))
+	}
+}
+
+func (bar *ProgressBar) Show(p checkset.Progress) {
+	const MB = 1024*1024
+	bar.lock.Lock()
+	if !bar.terminal {
+		due := p.Bytes > bar.logged + MB * 5
+		if due {
+			bar.logged = p.Bytes
+		}
+		bar.lock.Unlock()
+		// the log may be written through bar, which takes the lock
+		if due {
+			log.Printf("downloaded %d MB", p.Bytes / MB)
+		}
+		return
+	}
+	defer bar.lock.Unlock()
+	// redrawing is slow on some terminals
+	if time.Since(bar.drawn) < 100 * time.Millisecond {
+		return
+	}
+	bar.drawn = time.Now()
+	bar.erase()
+	bar.line = RenderProgress(p)
+	fmt.Fprint(bar.out, bar.line)
+}
+
+func (bar *ProgressBar) Clear() {
+	bar.lock.Lock()
+	defer bar.lock.Unlock()
+	bar.erase()
+	bar.line = ""
+	bar.logged = 0
+}
+
+// for use as log output
+func (bar *ProgressBar) Write(p []byte) (int, error) {
+	bar.lock.Lock()
+	defer bar.lock.Unlock()
+	bar.erase()
+	n, err := bar.out.Write(p)
+	fmt.Fprint(bar.out, bar.line)
+	return n, err
+}
+
+var Bar = NewProgressBar(os.Stderr)
+
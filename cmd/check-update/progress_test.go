@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/rspeele/check-update/checkset"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShowNotTerminal(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log")
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	bar := NewProgressBar(out)
+	if bar.terminal {
+		t.Fatal("file taken for a terminal")
+	}
+	log.SetOutput(bar)
+	done := make(chan bool)
+	go func() {
+		bar.Show(checkset.Progress { Bytes: 6 * 1024 * 1024 })
+		bar.Show(checkset.Progress { Bytes: 7 * 1024 * 1024 })
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Show deadlocked") // leaving the log stuck
+	}
+	log.SetOutput(os.Stderr)
+	logged, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(logged), "downloaded") != 1 || !strings.Contains(string(logged), "downloaded 6 MB") {
+		t.Errorf("logged %q, want one line for 6 MB", logged)
+	}
+}
@@ -0,0 +1,383 @@
+// archive.go - reading a release straight from a tar or zip archive
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rspeele/check-update/checkset"
+	"github.com/rspeele/check-update/futility"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var archiveSuffixes = []string { ".tar", ".tar.gz", ".tgz", ".zip" }
+
+// whether a source is an archive rather than a directory
+func IsArchive(name string) bool {
+	lower := strings.ToLower(name)
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// a file in an archive
+type ArchiveEntry struct {
+	Name string // slash-separated, relative to the top of the archive
+	Info os.FileInfo
+	Link string // symlink target
+	LinkedTo string // for hard links, the Name of the entry with the content
+	Content io.Reader // only good until the next entry is read
+	Replaced bool // by a later entry of the same Name, which is what extracting gives
+}
+
+// longest symlink target read from a zip
+const maxZipLink = 4096
+
+// entry names as they would be in a CheckSet; "" for the top itself
+func archiveName(name string) (string, error) {
+	name = strings.TrimLeft(name, "/")
+	if name == "" {
+		return "", nil
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", nil
+	} else if !checkset.ValidName(name) {
+		return "", fmt.Errorf("bad name in archive: %q", name)
+	}
+	return name, nil
+}
+
+// call each with the header of each member of a tar, which may be gzipped
+func readTarHeaders(name string, each func(*tar.Header, *tar.Reader) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stream, err := checkset.Decompress(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	reader := tar.NewReader(stream)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = each(header, reader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// call each with each regular file, directory and link in a tar, which
+// may be gzipped. the tar is read twice, the first time to find which
+// members are replaced by later ones.
+func ReadTar(name string, each func(ArchiveEntry) error) error {
+	last := make(map[string]int) // index of the last member of each name
+	i := 0
+	err := readTarHeaders(name, func(header *tar.Header, _ *tar.Reader) error {
+		if member, err := archiveName(header.Name); err == nil {
+			last[member] = i
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	i = -1
+	return readTarHeaders(name, func(header *tar.Header, reader *tar.Reader) error {
+		i++
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+		default:
+			return nil // devices, pipes and the like
+		}
+		entry := ArchiveEntry { Info: header.FileInfo(), Link: header.Linkname, Content: reader }
+		var err error
+		entry.Name, err = archiveName(header.Name)
+		if err != nil || entry.Name == "" {
+			return err
+		}
+		entry.Replaced = last[entry.Name] != i
+		if header.Typeflag == tar.TypeLink {
+			entry.Link = ""
+			entry.LinkedTo, err = archiveName(header.Linkname)
+			if err != nil {
+				return err
+			}
+		}
+		return each(entry)
+	})
+}
+
+func readZipEntry(file *zip.File, replaced bool, each func(ArchiveEntry) error) error {
+	content, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	entry := ArchiveEntry { Info: file.FileInfo(), Content: content, Replaced: replaced }
+	entry.Name, err = archiveName(file.Name)
+	if err != nil || entry.Name == "" {
+		return err
+	}
+	if entry.Info.Mode() & os.ModeSymlink != 0 {
+		link, err := io.ReadAll(io.LimitReader(content, maxZipLink + 1))
+		if err != nil {
+			return err
+		} else if len(link) > maxZipLink {
+			return errors.New("symlink target too long in archive: " + entry.Name)
+		}
+		entry.Link = string(link)
+	}
+	return each(entry)
+}
+
+// call each with each file, directory and link in a zip
+func ReadZip(name string, each func(ArchiveEntry) error) error {
+	reader, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	last := make(map[string]int) // index of the last file of each name
+	for i, file := range reader.File {
+		if name, err := archiveName(file.Name); err == nil {
+			last[name] = i
+		}
+	}
+	for i, file := range reader.File {
+		name, _ := archiveName(file.Name)
+		err = readZipEntry(file, last[name] != i, each)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ReadArchive(name string, each func(ArchiveEntry) error) error {
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		return ReadZip(name, each)
+	}
+	return ReadTar(name, each)
+}
+
+// hash content, copying it to where it is to be published as it goes,
+// so that nothing need be extracted first. returns where it was copied,
+// if anywhere.
+func extract(opts Options, rel string, info checkset.CreateInfo, content io.Reader) (checkset.CheckInfo, string, error) {
+	if opts.Store == "" && opts.Publish == "" {
+		known, err := checkset.CreateCheckInfo(info, content, "")
+		return known, "", err
+	}
+	var out *os.File
+	var err error
+	var final string
+	if opts.Store != "" {
+		// can't know where it goes until it has been hashed
+		err = os.MkdirAll(opts.Store, 0755)
+		if err == nil {
+			out, err = os.CreateTemp(opts.Store, "archive-*.part")
+		}
+	} else {
+		final, err = PublishPath(opts, rel)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(final), 0755)
+		}
+		if err == nil {
+			out, err = futility.Create(final + ".part", info.Mode & os.ModePerm)
+		}
+	}
+	if err != nil {
+		return checkset.CheckInfo{}, "", err
+	}
+	known, err := checkset.CreateCheckInfo(info, io.TeeReader(content, out), "")
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && opts.Store != "" {
+		final = filepath.Join(opts.Store, filepath.FromSlash(checkset.ObjectPath(known.Hash)))
+		err = os.MkdirAll(filepath.Dir(final), 0755)
+		if err == nil {
+			err = os.Chmod(out.Name(), info.Mode & os.ModePerm)
+		}
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), final)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return known, "", err
+	}
+	return known, final, nil
+}
+
+var errFound = errors.New("found")
+
+// extract the entry at position in the archive src.Root, as for
+// extract, for a hard link to a file that wasn't put in the release
+func extractAgain(opts Options, src Source, position int, rel string, info checkset.CreateInfo) (checkset.CheckInfo, string, error) {
+	var known checkset.CheckInfo
+	var copied string
+	i := 0
+	err := ReadArchive(src.Root, func(entry ArchiveEntry) error {
+		i++
+		if i - 1 != position {
+			return nil
+		}
+		var err error
+		known, copied, err = extract(opts, rel, info, entry.Content)
+		if err == nil {
+			err = errFound
+		}
+		return err
+	})
+	if err == errFound {
+		return known, copied, nil
+	} else if err == nil {
+		err = errors.New("archive changed while reading it")
+	}
+	return known, copied, err
+}
+
+// a file's details, but with a size from elsewhere
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (info sizedInfo) Size() int64 {
+	return info.size
+}
+
+// send the files in the archive src.Root to out, hashing them as they
+// are read, and returning as FilterTranslate does. .checkignore files
+// in archives aren't honored.
+func WalkArchive(opts Options, src Source, out chan checkset.CreateInfo, tree Tree) (int, int, error) {
+	reused, hashed := 0, 0
+	var excluded []string // directories left out, with everything in them
+	known := make(map[string]*checkset.CheckInfo) // by entry name, for hard links
+	// regular files left out, by entry name, in case hard links want them
+	type skippedEntry struct {
+		position int
+		info os.FileInfo
+	}
+	skipped := make(map[string]skippedEntry)
+	position := -1
+	err := ReadArchive(src.Root, func(entry ArchiveEntry) error {
+		position++
+		rel := path.Join(src.Prefix, entry.Name)
+		skip := func() error {
+			delete(known, entry.Name)
+			if entry.Info.Mode().IsRegular() && entry.LinkedTo == "" {
+				skipped[entry.Name] = skippedEntry { position, entry.Info }
+			}
+			return nil
+		}
+		if entry.Replaced {
+			return skip()
+		}
+		for _, dir := range excluded {
+			if strings.HasPrefix(rel, dir + "/") {
+				return skip()
+			}
+		}
+		platform := GetPlatform(opts, rel)
+		if platform.OS == 0 || platform.Arch == 0 {
+			if entry.Info.IsDir() {
+				excluded = append(excluded, rel)
+			}
+			return skip()
+		}
+		stat := futility.StatFile { Name: src.Root + ":" + entry.Name, Info: entry.Info }
+		linked, linkedKnown := known[entry.LinkedTo]
+		target, linkedSkipped := skipped[entry.LinkedTo]
+		if entry.LinkedTo != "" {
+			// the link's header doesn't have the size, which decides
+			// whether blocks are hashed
+			switch {
+			case linkedKnown:
+				stat.Info = sizedInfo { entry.Info, linked.Size }
+			case linkedSkipped:
+				stat.Info = sizedInfo { entry.Info, target.info.Size() }
+			default:
+				return fmt.Errorf("%s: hard link to %s, which isn't before it", stat.Name, entry.LinkedTo)
+			}
+		}
+		info := GetInfo(opts, rel, stat)
+		mode := entry.Info.Mode()
+		switch {
+		case mode & os.ModeSymlink != 0:
+			link, _ := checkset.CreateCheckInfo(info, nil, entry.Link)
+			info.Known = &link
+		case !mode.IsRegular():
+		case entry.LinkedTo != "" && linkedKnown:
+			info.Known = linked
+			from := tree.Files[path.Join(src.Prefix, entry.LinkedTo)]
+			if from != "" && opts.Store == "" {
+				to, err := PublishPath(opts, rel)
+				if err == nil {
+					err = os.MkdirAll(filepath.Dir(to), 0755)
+				}
+				if err == nil {
+					err = futility.CopyFile(from, to, info.Mode & os.ModePerm)
+				}
+				if err != nil {
+					return err
+				}
+				from = to
+			}
+			tree.Files[rel] = from
+		case entry.LinkedTo != "":
+			// its content was passed over, so has to be read again
+			hashed++
+			hash, copied, err := extractAgain(opts, src, target.position, rel, info)
+			if err != nil {
+				return fmt.Errorf("%s: %s", stat.Name, err)
+			}
+			info.Known = &hash
+			tree.Files[rel] = copied
+		default:
+			tree.Index.Add(rel, entry.Info)
+			if info.Known != nil && checkset.Reusable(*info.Known, info) && opts.Store == "" && opts.Publish == "" {
+				reused++
+				break
+			} else if opts.Previous != nil {
+				log.Printf("hashing %s", rel)
+			}
+			hashed++
+			hash, copied, err := extract(opts, rel, info, entry.Content)
+			if err != nil {
+				return fmt.Errorf("%s: %s", stat.Name, err)
+			}
+			info.Known = &hash
+			tree.Files[rel] = copied
+		}
+		if mode.IsRegular() {
+			known[entry.Name] = info.Known
+		} else {
+			delete(known, entry.Name)
+		}
+		out <- info
+		return nil
+	})
+	return reused, hashed, err
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/rspeele/check-update/checkset"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type member struct {
+	name string
+	kind byte // a tar.Type, or for zips, tar.TypeSymlink or anything else
+	mode int64
+	content string // or the link target
+}
+
+func regular(name, content string) member {
+	return member { name, tar.TypeReg, 0644, content }
+}
+
+func writeTar(t *testing.T, name string, members []member) string {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	for _, m := range members {
+		header := tar.Header { Name: m.name, Typeflag: m.kind, Mode: m.mode }
+		switch m.kind {
+		case tar.TypeReg:
+			header.Size = int64(len(m.content))
+		case tar.TypeSymlink, tar.TypeLink:
+			header.Linkname = m.content
+		}
+		if err := writer.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if m.kind == tar.TypeReg {
+			writer.Write([]byte(m.content))
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if strings.HasSuffix(name, "gz") {
+		var zipped bytes.Buffer
+		gz := gzip.NewWriter(&zipped)
+		gz.Write(data)
+		gz.Close()
+		data = zipped.Bytes()
+	}
+	full := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(full, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return full
+}
+
+func writeZip(t *testing.T, members []member) string {
+	full := filepath.Join(t.TempDir(), "release.zip")
+	file, err := os.Create(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	for _, m := range members {
+		header := zip.FileHeader { Name: m.name }
+		mode := os.FileMode(m.mode)
+		switch m.kind {
+		case tar.TypeSymlink:
+			mode |= os.ModeSymlink
+		case tar.TypeDir:
+			mode |= os.ModeDir
+			header.Name += "/"
+		}
+		header.SetMode(mode)
+		w, err := writer.CreateHeader(&header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, m.content)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return full
+}
+
+func archiveCheckSet(t *testing.T, opts Options) checkset.CheckSet {
+	cset, _, err := MakeCheckSet(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cset
+}
+
+var testMembers = []member {
+	{ "./", tar.TypeDir, 0755, "" },
+	{ "bin/", tar.TypeDir, 0755, "" },
+	{ "bin/app", tar.TypeReg, 0755, "program" },
+	{ "bin/app-link", tar.TypeSymlink, 0777, "app" },
+	{ "/lib/data", tar.TypeReg, 0600, "data" },
+	{ "empty/", tar.TypeDir, 0700, "" },
+	{ "lib/./sub/../more", tar.TypeReg, 0644, "more" },
+}
+
+func checkTestMembers(t *testing.T, cset checkset.CheckSet) {
+	want := map[string]os.FileMode {
+		"bin/app": 0755,
+		"bin/app-link": os.ModeSymlink | 0777,
+		"lib/data": 0600,
+		"empty": os.ModeDir | 0700,
+		"lib/more": 0644,
+	}
+	if len(cset) != len(want) {
+		t.Errorf("got %v", checkset.SortedNames(cset))
+	}
+	for name, mode := range want {
+		if cset[name].Mode != mode {
+			t.Errorf("%s: mode %v, want %v", name, cset[name].Mode, mode)
+		}
+	}
+	if cset["bin/app"].Hash != checkset.HashLink("program") || cset["bin/app-link"].Link != "app" {
+		t.Errorf("got %+v and %+v", cset["bin/app"], cset["bin/app-link"])
+	}
+}
+
+func TestReadTar(t *testing.T) {
+	for _, name := range []string { "release.tar", "release.tgz", "release.tar.gz" } {
+		archive := writeTar(t, name, append(testMembers, member { "fifo", tar.TypeFifo, 0644, "" }))
+		checkTestMembers(t, archiveCheckSet(t, testOptions(Source { archive, "" })))
+	}
+}
+
+func TestReadZip(t *testing.T) {
+	checkTestMembers(t, archiveCheckSet(t, testOptions(Source { writeZip(t, testMembers), "" })))
+}
+
+func TestArchiveTraversal(t *testing.T) {
+	bad := [][]member {
+		{ regular("../escape", "x") },
+		{ regular("a/../../escape", "x") },
+		{ regular("a", "x"), { "b", tar.TypeLink, 0644, "../a" } },
+	}
+	for i, members := range bad {
+		archive := writeTar(t, "release.tar", members)
+		if _, _, err := MakeCheckSet(testOptions(Source { archive, "" })); err == nil {
+			t.Errorf("%d: read an archive with names outside it", i)
+		}
+	}
+	archive := writeZip(t, []member { regular("../escape", "x") })
+	if _, _, err := MakeCheckSet(testOptions(Source { archive, "" })); err == nil {
+		t.Error("read a zip with names outside it")
+	}
+	// links out are caught by Create
+	archive = writeTar(t, "release.tar", []member { { "link", tar.TypeSymlink, 0777, "../../etc" } })
+	if _, _, err := MakeCheckSet(testOptions(Source { archive, "" })); err == nil {
+		t.Error("read a symlink out of the archive")
+	}
+}
+
+func TestArchiveHardLinks(t *testing.T) {
+	archive := writeTar(t, "release.tar", []member {
+		regular("big", "12345678"),
+		{ "big-link", tar.TypeLink, 0755, "big" },
+		{ "early", tar.TypeLink, 0644, "late" },
+	})
+	if _, _, err := MakeCheckSet(testOptions(Source { archive, "" })); err == nil {
+		t.Error("read a link to a file after it")
+	}
+	archive = writeTar(t, "release.tar", []member {
+		regular("big", "12345678"),
+		{ "big-link", tar.TypeLink, 0755, "big" },
+	})
+	cset := archiveCheckSet(t, testOptions(Source { archive, "" }))
+	link := cset["big-link"]
+	// blocks are hashed, since the size of the link is known
+	if link.Hash != cset["big"].Hash || link.Size != 8 || link.BlockSize != 2 || len(link.Blocks) != 4 {
+		t.Errorf("got %+v", link)
+	}
+	if link.Mode != 0755 {
+		t.Errorf("got mode %v for the link", link.Mode)
+	}
+}
+
+func TestArchiveLinkToExcluded(t *testing.T) {
+	archive := writeTar(t, "release.tar", []member {
+		{ "build/", tar.TypeDir, 0755, "" },
+		regular("build/big", "12345678"),
+		regular("other", "1"),
+		{ "big", tar.TypeLink, 0644, "build/big" },
+		{ "unused", tar.TypeLink, 0644, "other" },
+	})
+	specs, err := ReadSpecs(strings.NewReader("exclude build\nexclude other\n"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, publish := range []bool { false, true } {
+		opts := testOptions(Source { archive, "" })
+		opts.Specs = specs
+		if publish {
+			opts.Publish = t.TempDir()
+		}
+		cset, tree, err := MakeCheckSet(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		big := cset["big"]
+		if len(cset) != 2 || big.Hash != checkset.HashLink("12345678") || len(big.Blocks) != 4 {
+			t.Errorf("got %v, with big %+v", checkset.SortedNames(cset), big)
+		}
+		if publish {
+			data, err := ioutil.ReadFile(tree.Files["big"])
+			if err != nil || string(data) != "12345678" {
+				t.Errorf("published %q, %v", data, err)
+			}
+		}
+	}
+}
+
+func TestArchiveDuplicates(t *testing.T) {
+	archive := writeTar(t, "release.tar", []member {
+		regular("a", "1"),
+		{ "old", tar.TypeLink, 0644, "a" },
+		regular("a", "22"),
+		{ "new", tar.TypeLink, 0644, "a" },
+		{ "d/", tar.TypeDir, 0755, "" },
+		regular("d", "file now"),
+	})
+	cset := archiveCheckSet(t, testOptions(Source { archive, "" }))
+	want := map[string]string { "a": "22", "old": "1", "new": "22", "d": "file now" }
+	if len(cset) != len(want) {
+		t.Errorf("got %v", checkset.SortedNames(cset))
+	}
+	for name, content := range want {
+		if cset[name].Hash != checkset.HashLink(content) || cset[name].Mode != 0644 {
+			t.Errorf("%s: got %+v, want %q", name, cset[name], content)
+		}
+	}
+	archive = writeZip(t, []member { regular("a", "1"), regular("a", "22") })
+	cset = archiveCheckSet(t, testOptions(Source { archive, "" }))
+	if len(cset) != 1 || cset["a"].Size != 2 {
+		t.Errorf("got %+v from a zip", cset)
+	}
+}
+
+// a file where the checkset is to be published is refused before the
+// last release's checkset is written over
+func TestArchivePublishOverCheckSet(t *testing.T) {
+	archive := writeTar(t, "release.tar", []member { regular(DefaultCheckSet, "bogus") })
+	opts := testOptions(Source { archive, "" })
+	opts.Publish = t.TempDir()
+	opts.Output = filepath.Join(opts.Publish, DefaultCheckSet)
+	ioutil.WriteFile(opts.Output, []byte("last release"), 0644)
+	if _, _, err := MakeCheckSet(opts); err == nil {
+		t.Error("published a file over the checkset")
+	}
+	if data, _ := ioutil.ReadFile(opts.Output); string(data) != "last release" {
+		t.Errorf("checkset now %q", data)
+	}
+}
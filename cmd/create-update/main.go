@@ -0,0 +1,699 @@
+package main
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rspeele/check-update/checkset"
+	"github.com/rspeele/check-update/delta"
+	"github.com/rspeele/check-update/futility"
+	"github.com/rspeele/check-update/updater"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	Specs Specs
+	Sources []Source
+	Output string
+	Compress bool
+	BlockThreshold int64
+	BlockSize int64
+	PatchFrom string
+	PatchDir string // if empty, patches go in Publish, or else the current directory
+	Store string
+	Meta checkset.Meta
+	ShowIgnored bool
+	Publish string
+	Previous checkset.CheckSet // nil if there is no previous release to reuse hashes from
+	PreviousIndex checkset.Index
+	Index string // file to write the index of this release to, if any
+	Lint string // one of the Lint values
+}
+
+// values of -lint
+const (
+	LintOff = "off"
+	LintWarn = "warn"
+	LintFail = "fail"
+)
+
+// a directory whose files go under Prefix in the release
+type Source struct {
+	Root string
+	Prefix string // slash-separated; empty for the top of the release
+}
+
+// where name, found under src.Root, goes in the release
+func (src Source) ReleaseName(name string) string {
+	rel, err := filepath.Rel(src.Root, name)
+	if err != nil {
+		rel = name
+	}
+	return path.Join(src.Prefix, filepath.ToSlash(rel))
+}
+
+// collects repeated -source dir=prefix flags
+type SourceFlag []Source
+
+func (sources *SourceFlag) String() string {
+	return ""
+}
+
+func (sources *SourceFlag) Set(mapping string) error {
+	root, prefix := mapping, ""
+	if split := strings.LastIndex(mapping, "="); split >= 0 {
+		root, prefix = mapping[:split], mapping[split + 1:]
+	}
+	if prefix = path.Clean(filepath.ToSlash(prefix)); prefix == "." {
+		prefix = ""
+	}
+	if root == "" || (prefix != "" && !checkset.ValidName(prefix)) {
+		return errors.New("expected dir=prefix, with a relative prefix, got " + mapping)
+	}
+	*sources = append(*sources, Source { root, prefix })
+	return nil
+}
+
+// where the files of a release came from
+type Tree struct {
+	Index checkset.Index
+	Files map[string]string // file each name in the release was made from, if it is on disk
+}
+
+// collects repeated -meta key=value flags
+type MetaFlag map[string]string
+
+func (extra MetaFlag) String() string {
+	return ""
+}
+
+func (extra MetaFlag) Set(pair string) error {
+	split := strings.SplitN(pair, "=", 2)
+	if len(split) < 2 || split[0] == "" {
+		return errors.New("expected key=value, got " + pair)
+	}
+	extra[split[0]] = split[1]
+	return nil
+}
+
+// the -built time: "now", Unix seconds, or if empty, SOURCE_DATE_EPOCH.
+// without either the release has no build time, so that builds of
+// identical trees are identical.
+func BuildTime(built string) (time.Time, error) {
+	if built == "" {
+		built = os.Getenv("SOURCE_DATE_EPOCH")
+		if built == "" {
+			return time.Time{}, nil
+		}
+	}
+	if built == "now" {
+		return time.Now().UTC(), nil
+	}
+	secs, err := strconv.ParseInt(built, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("bad build time " + built + "; expected now or Unix seconds")
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+func GetOptions() Options {
+	root := flag.String("root", ".", "directory, or tar or zip archive, from which to generate the update")
+	var sources SourceFlag
+	flag.Var(&sources, "source", "dir=prefix: put the files in dir, which may be a tar or zip archive, under prefix in the release, " +
+		"instead of using -root; may be repeated")
+	output := flag.String("output", "", "file to write checkset to; stdout if not specified, or " +
+		"when publishing, a name for it in the publish directory, " + DefaultCheckSet + " if not specified")
+	specify := flag.Bool("specify", false, "read pattern:platform lines from stdin; see -spec for more")
+	specFile := flag.String("spec", "", "file of include and exclude rules, or - for stdin")
+	compress := flag.Bool("compress", false, "gzip the checkset")
+	blockThreshold := flag.Int64("block-threshold", 16<<20, "list block hashes for files larger than this; 0 for none")
+	blockSize := flag.Int64("block-size", 1<<20, "size of blocks to hash in large files")
+	patchFrom := flag.String("patch-from", "", "directory of the previous release to make patches from")
+	patchDir := flag.String("patch-dir", "", "directory to write patches to, laid out as the update server expects; " +
+		"defaults to the publish directory or the current one")
+	store := flag.String("store", "", "content-addressed store to copy files to; the release will fetch files from it by hash")
+	release := flag.String("release", "", "release name or version")
+	channel := flag.String("channel", "", "release channel, e.g. stable")
+	showIgnored := flag.Bool("show-ignored", false, "list files left out by " + futility.IgnoreFile + " files")
+	publish := flag.String("publish", "", "write the checkset and every file it lists to this directory, laid out as the update server expects")
+	byHash := flag.Bool("by-hash", false, "when publishing, lay files out by content hash as -store does")
+	previous := flag.String("previous", "", "checkset of the previous release, to reuse the hashes of files unchanged since; " +
+		"its index is read from the file of the same name plus " + IndexSuffix)
+	index := flag.String("index", "", "file to write an index of file sizes and times to, for -previous; " +
+		"defaults to the output plus " + IndexSuffix)
+	lint := flag.String("lint", LintWarn, "report names that would break on some clients: " +
+		LintOff + ", " + LintWarn + ", or " + LintFail + " to write nothing if there are any")
+	minUpdater := flag.Uint("min-updater", 0, "oldest updater version able to apply the release")
+	built := flag.String("built", "", "build time of the release: now, or Unix seconds; " +
+		"defaults to SOURCE_DATE_EPOCH, or none so that output is reproducible")
+	extra := make(MetaFlag)
+	flag.Var(extra, "meta", "extra key=value metadata; may be repeated")
+	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "root" && len(sources) > 0 {
+			log.Fatal("use either -root or -source, not both")
+		}
+	})
+	if len(sources) == 0 {
+		sources = SourceFlag { { *root, "" } }
+	}
+	buildTime, err := BuildTime(*built)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *minUpdater > 0xffff {
+		log.Fatalf("bad -min-updater %d; it can be at most %d", *minUpdater, 0xffff)
+	}
+	meta := checkset.Meta {
+		Release: *release,
+		Built: buildTime,
+		MinUpdater: uint16(*minUpdater),
+		Channel: *channel,
+		Extra: extra,
+	}
+	var specs Specs
+	switch {
+	case *specify && *specFile != "":
+		log.Fatal("use either -spec or -specify, not both")
+	case *specify:
+		specs, err = ReadSpecific(os.Stdin)
+	case *specFile != "":
+		specs, err = ReadSpecFile(*specFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *lint != LintOff && *lint != LintWarn && *lint != LintFail {
+		log.Fatalf("bad -lint %q; expected %s, %s or %s", *lint, LintOff, LintWarn, LintFail)
+	}
+	if *byHash && *publish == "" {
+		log.Fatal("-by-hash only makes sense with -publish")
+	}
+	if *byHash && *store != "" {
+		log.Fatal("use either -by-hash or -store; -publish with -store publishes files by hash anyway")
+	}
+	if *publish != "" {
+		if *output == "" {
+			*output = DefaultCheckSet
+		}
+		*output = filepath.Join(*publish, *output)
+		if *byHash && *store == "" {
+			*store = *publish
+		}
+	}
+	if *store != "" {
+		meta.Layout = checkset.ContentLayout
+	}
+	if *index == "" && *output != "" {
+		*index = *output + IndexSuffix
+	}
+	var prev checkset.CheckSet
+	var prevIndex checkset.Index
+	if *previous != "" {
+		prev, prevIndex, err = ReadPrevious(*previous)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *blockThreshold <= 0 || *blockSize <= 0 {
+		*blockThreshold = -1
+	}
+	return Options {
+		specs,
+		sources,
+		*output,
+		*compress,
+		*blockThreshold,
+		*blockSize,
+		*patchFrom,
+		*patchDir,
+		*store,
+		meta,
+		*showIgnored,
+		*publish,
+		prev,
+		prevIndex,
+		*index,
+		*lint,
+	}
+}
+
+// an index is written beside the checkset unless -index says otherwise
+const IndexSuffix = ".index"
+
+// read the checkset of the previous release and its index. without the
+// index, nothing can be reused.
+func ReadPrevious(name string) (checkset.CheckSet, checkset.Index, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, checkset.Index{}, err
+	}
+	defer file.Close()
+	_, cset, err := checkset.Read(file)
+	if err != nil {
+		return nil, checkset.Index{}, fmt.Errorf("reading %s: %s", name, err)
+	}
+	ifile, err := os.Open(name + IndexSuffix)
+	if os.IsNotExist(err) {
+		log.Printf("%s has no index, so every file will be hashed", name)
+		return cset, checkset.NewIndex(time.Time{}), nil
+	} else if err != nil {
+		return nil, checkset.Index{}, err
+	}
+	defer ifile.Close()
+	index, err := checkset.ReadIndex(bufio.NewReader(ifile))
+	if err != nil {
+		return nil, checkset.Index{}, fmt.Errorf("reading %s: %s", name + IndexSuffix, err)
+	}
+	return cset, index, nil
+}
+
+// the rule for rel, a name in the release, or nil if there is none
+func GetSpec(opts Options, rel string) *Spec {
+	if rel == "." {
+		return nil
+	}
+	return opts.Specs.Find(rel)
+}
+
+// excluded files have no platform
+func GetPlatform(opts Options, rel string) checkset.Platform {
+	spec := GetSpec(opts, rel)
+	switch {
+	case spec == nil:
+		return checkset.AllPlatforms
+	case spec.Exclude:
+		return checkset.Platform{}
+	}
+	return spec.Target
+}
+// rel is where the file goes in the release
+func GetInfo(opts Options, rel string, stat futility.StatFile) checkset.CreateInfo {
+	var blockSize int64
+	if opts.BlockThreshold >= 0 && stat.Info.Size() > opts.BlockThreshold {
+		blockSize = opts.BlockSize
+	}
+	mode := stat.Info.Mode()
+	if spec := GetSpec(opts, rel); spec != nil && mode & os.ModeSymlink == 0 {
+		mode = spec.Mode.Apply(mode)
+	}
+	var known *checkset.CheckInfo
+	if prev, ok := opts.Previous[rel]; ok && opts.PreviousIndex.Unchanged(rel, stat.Info) {
+		known = &prev
+	}
+	return checkset.CreateInfo {
+		Name: stat.Name,
+		Mode: mode,
+		Size: stat.Info.Size(),
+		Target: GetPlatform(opts, rel),
+		BlockSize: blockSize,
+		Path: rel,
+		Known: known,
+	}
+}
+
+// also adds what it sees to tree and, if there is a previous release,
+// says which files need hashing. returns how many files' hashes were
+// reused and how many need hashing.
+func FilterTranslate(opts Options, src Source, in chan futility.StatFile, out chan checkset.CreateInfo, tree Tree) (int, int) {
+	reused, hashed := 0, 0
+	for sf := range in {
+		info := GetInfo(opts, src.ReleaseName(sf.Name), sf)
+		tree.Files[info.Path] = sf.Name
+		if sf.Info.Mode().IsRegular() {
+			tree.Index.Add(info.Path, sf.Info)
+			if info.Known != nil && checkset.Reusable(*info.Known, info) {
+				reused++
+			} else if opts.Previous != nil {
+				log.Printf("hashing %s", info.Path)
+				hashed++
+			}
+		}
+	 	out <- info
+	}
+	return reused, hashed
+}
+
+// send the files under src.Root to out, returning as FilterTranslate does
+func WalkDirectory(opts Options, src Source, out chan checkset.CreateInfo, tree Tree) (int, int, error) {
+	// don't put the last release, its patches, the store, or the checkset
+	// and index being written, in this one
+	var outputs []string
+	for _, dir := range []string { opts.Publish, opts.PatchDir, opts.Store, opts.Output, opts.Index } {
+		if dir != "" {
+			abs, _ := filepath.Abs(dir)
+			outputs = append(outputs, abs)
+		}
+	}
+	root, _ := filepath.Abs(src.Root)
+	filter := func(statfile futility.StatFile) bool {
+		abs, _ := filepath.Abs(statfile.Name)
+		for _, dir := range outputs {
+			if abs == dir && abs != root {
+				return false
+			}
+		}
+		platform := GetPlatform(opts, src.ReleaseName(statfile.Name))
+		return platform.OS != 0 && platform.Arch != 0
+	}
+	var ignored chan futility.StatFile
+	logged := make(chan bool)
+	if opts.ShowIgnored {
+		ignored = make(chan futility.StatFile)
+		go func() {
+			for sf := range ignored {
+				log.Printf("ignored %s", sf.Name)
+			}
+			close(logged)
+		}()
+	} else {
+		close(logged)
+	}
+	files := make(chan futility.StatFile)
+	rerc := make(chan error, 1)
+	go func() {
+		rerc <- futility.Recurse(src.Root, filter, files, ignored)
+	}()
+	reused, hashed := FilterTranslate(opts, src, files, out, tree)
+	err := <-rerc
+	<-logged
+	return reused, hashed, err
+}
+
+// logs every file that can't be read, and fails if there were any,
+// rather than make a release without them. sources are walked in
+// order, and must not provide the same files.
+func MakeCheckSet(opts Options) (checkset.CheckSet, Tree, error) {
+	tree := Tree { checkset.NewIndex(time.Now()), make(map[string]string) }
+	pipe := make(chan checkset.CreateInfo)
+	generate := make(chan checkset.CheckSet)
+	errs := make(chan *checkset.FileError)
+	werc := make(chan error, 1)
+	go func() {
+		defer close(pipe)
+		reused, hashed := 0, 0
+		for _, src := range opts.Sources {
+			walk := WalkDirectory
+			if IsArchive(src.Root) {
+				walk = WalkArchive
+			}
+			r, h, err := walk(opts, src, pipe, tree)
+			reused, hashed = reused + r, hashed + h
+			if err != nil {
+				werc <- err
+				return
+			}
+		}
+		if opts.Previous != nil {
+			log.Printf("reused the hashes of %d files and hashed %d", reused, hashed)
+		}
+		werc <- nil
+	}()
+	go checkset.Create("", pipe, generate, errs)
+	var failed checkset.FileErrors
+	for err := range errs {
+		log.Print(err)
+		failed = append(failed, err)
+	}
+	cset := <-generate
+	if err := <-werc; err != nil {
+		return nil, tree, err
+	}
+	if len(failed) > 0 {
+		return nil, tree, failed
+	}
+	return cset, tree, nil
+}
+
+// returns the size of the patch written, which is removed if it would
+// be no smaller than the file it patches to
+func MakePatch(old, new, patch string, limit int64) (int64, error) {
+	oldFile, err := os.Open(old)
+	if err != nil {
+		return 0, err
+	}
+	defer oldFile.Close()
+	oldInfo, err := oldFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	newFile, err := os.Open(new)
+	if err != nil {
+		return 0, err
+	}
+	defer newFile.Close()
+	err = os.MkdirAll(filepath.Dir(patch), 0755)
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.Create(patch)
+	if err != nil {
+		return 0, err
+	}
+	err = delta.Diff(oldFile, oldInfo.Size(), newFile, out)
+	size, _ := out.Seek(0, io.SeekCurrent)
+	out.Close()
+	if err != nil || size >= limit {
+		os.Remove(patch)
+	}
+	return size, err
+}
+
+// write patches from files of the previous release to their
+// counterparts in cset, and list the previous versions as bases
+func MakePatches(opts Options, tree Tree, cset checkset.CheckSet) error {
+	patchDir := opts.PatchDir
+	if patchDir == "" {
+		patchDir = opts.Publish
+	}
+	if patchDir == "" {
+		patchDir = "."
+	}
+	for _, name := range checkset.SortedNames(cset) {
+		info := cset[name]
+		old := filepath.Join(opts.PatchFrom, filepath.FromSlash(name))
+		if info.Mode & os.ModeType != 0 || !futility.FileExists(old) {
+			continue
+		}
+		base, err := checkset.HashFile(old)
+		if err != nil {
+			return err
+		}
+		if base == info.Hash {
+			continue
+		}
+		new := tree.Files[name]
+		if new == "" {
+			return errors.New("can't make a patch for " + name + " from an archive without -publish or -store")
+		}
+		patch := filepath.Join(patchDir, filepath.FromSlash(checkset.PatchPath(base, info.Hash)))
+		size, err := MakePatch(old, new, patch, info.Size)
+		if err != nil {
+			return err
+		}
+		if size < info.Size {
+			log.Printf("patch for %s is %d of %d bytes", name, size, info.Size)
+			info.Bases = append(info.Bases, base)
+			cset[name] = info
+		}
+	}
+	return nil
+}
+
+// copy each file in cset to where a content-addressed server rooted at
+// store would have it, unless it already has it from this or an
+// earlier release
+func PopulateStore(store string, tree Tree, cset checkset.CheckSet) error {
+	for _, name := range checkset.SortedNames(cset) {
+		info := cset[name]
+		object := filepath.Join(store, filepath.FromSlash(checkset.ObjectPath(info.Hash)))
+		if info.Mode & os.ModeType != 0 || futility.FileExists(object) {
+			continue
+		}
+		err := os.MkdirAll(filepath.Dir(object), 0755)
+		if err != nil {
+			return err
+		}
+		from := tree.Files[name]
+		err = futility.CopyFile(from, object + ".part", info.Mode & os.ModePerm)
+		if err == nil {
+			err = os.Rename(object + ".part", object)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// where the file rel is published, unless the checkset or its index go
+// there instead
+func PublishPath(opts Options, rel string) (string, error) {
+	to := filepath.Join(opts.Publish, filepath.FromSlash(rel))
+	for _, output := range []string { opts.Output, opts.Index } {
+		if output != "" && to == filepath.Clean(output) {
+			return "", errors.New("release has a file where the checkset is to be published: " + rel)
+		}
+	}
+	return to, nil
+}
+
+// copy each file in cset to its path under the publish directory,
+// unless it is already there
+func PublishFiles(opts Options, tree Tree, cset checkset.CheckSet) error {
+	for _, name := range checkset.SortedNames(cset) {
+		info := cset[name]
+		to, err := PublishPath(opts, name)
+		if err != nil {
+			return err
+		}
+		if info.Mode & os.ModeType != 0 || checkset.CheckHash(to, info.Hash) {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(to), 0755)
+		if err != nil {
+			return err
+		}
+		from := tree.Files[name]
+		err = futility.CopyFile(from, to + ".part", info.Mode & os.ModePerm)
+		if err == nil {
+			err = os.Rename(to + ".part", to)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// name of the checkset in the publish directory if -output doesn't say
+const DefaultCheckSet = "checkset.chk"
+
+func writeCheckSet(opts Options, cset checkset.CheckSet, out io.Writer) error {
+	if opts.Compress {
+		compress, err := checkset.Compress(out)
+		if err != nil {
+			return err
+		}
+		err = checkset.Write(opts.Meta, cset, compress)
+		if err != nil {
+			return err
+		}
+		return compress.Close()
+	}
+	return checkset.Write(opts.Meta, cset, out)
+}
+
+// write to name once write has succeeded, rather than leave half a file
+func WriteWhole(name string, write func(io.Writer) error) error {
+	out, err := os.Create(name + ".part")
+	if err != nil {
+		return err
+	}
+	err = write(out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".part")
+		return err
+	}
+	return os.Rename(name + ".part", name)
+}
+
+// the checkset only replaces an earlier one once it is complete, so
+// that a server never has half of one
+func WriteCheckSet(opts Options, cset checkset.CheckSet) error {
+	if opts.Output == "" {
+		return writeCheckSet(opts, cset, os.Stdout)
+	}
+	return WriteWhole(opts.Output, func(out io.Writer) error {
+		return writeCheckSet(opts, cset, out)
+	})
+}
+
+// only files that made it into cset are indexed
+func WriteIndex(opts Options, cset checkset.CheckSet, index checkset.Index) error {
+	for name := range index.Files {
+		if _, ok := cset[name]; !ok {
+			delete(index.Files, name)
+		}
+	}
+	return WriteWhole(opts.Index, func(out io.Writer) error {
+		buffer := bufio.NewWriter(out)
+		err := checkset.WriteIndex(index, buffer)
+		if err != nil {
+			return err
+		}
+		return buffer.Flush()
+	})
+}
+
+func main() {
+	opts := GetOptions()
+	cset, tree, err := MakeCheckSet(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if required := updater.RequiredVersion(opts.Meta, cset); opts.Meta.MinUpdater < required {
+		opts.Meta.MinUpdater = required
+	}
+	if opts.Lint != LintOff {
+		problems := checkset.Lint(cset)
+		if len(problems) > 0 {
+			log.Printf("%d problems with names in the release", len(problems))
+			checkset.WriteProblems(os.Stderr, problems)
+			if opts.Lint == LintFail {
+				os.Exit(1)
+			}
+		}
+	}
+	if opts.PatchFrom != "" {
+		err := MakePatches(opts, tree, cset)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if opts.Store != "" {
+		err := PopulateStore(opts.Store, tree, cset)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the release fetches files by hash, so a server publishing it
+		// needs them laid out that way too
+		if opts.Publish != "" && filepath.Clean(opts.Publish) != filepath.Clean(opts.Store) {
+			err = PopulateStore(opts.Publish, tree, cset)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else if opts.Publish != "" {
+		err := PublishFiles(opts, tree, cset)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if opts.Publish != "" {
+		err = os.MkdirAll(opts.Publish, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = WriteCheckSet(opts, cset)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Index != "" {
+		err = WriteIndex(opts, cset, tree.Index)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"github.com/rspeele/check-update/checkset"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// makes a directory holding files, named by slash-separated paths
+func makeTree(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "create-update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	for name, content := range files {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(full), 0755)
+		err = ioutil.WriteFile(full, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func testOptions(sources ...Source) Options {
+	return Options {
+		Sources: sources,
+		BlockThreshold: 4,
+		BlockSize: 2,
+		Lint: LintOff,
+	}
+}
+
+func buildCheckSet(t *testing.T, opts Options) []byte {
+	cset, _, err := MakeCheckSet(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = writeCheckSet(opts, cset, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBuildTime(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	built, err := BuildTime("")
+	if err != nil || !built.IsZero() {
+		t.Errorf("got %v, %v; want no build time by default", built, err)
+	}
+	t.Setenv("SOURCE_DATE_EPOCH", "1400000000")
+	built, _ = BuildTime("")
+	if built.Unix() != 1400000000 {
+		t.Errorf("got %v, want SOURCE_DATE_EPOCH", built)
+	}
+	built, _ = BuildTime("5")
+	if built.Unix() != 5 {
+		t.Errorf("got %v, want -built over SOURCE_DATE_EPOCH", built)
+	}
+	if _, err = BuildTime("yesterday"); err == nil {
+		t.Error("accepted a bad build time")
+	}
+}
+
+// building the same tree again gives the same bytes, whatever the
+// files' times
+func TestReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	root := makeTree(t, map[string]string { "a": "1", "b/c": "23456", "b/d/e": "7" })
+	opts := testOptions(Source { root, "" })
+	built, _ := BuildTime("")
+	opts.Meta = checkset.Meta { Release: "1.0", Built: built }
+	first := buildCheckSet(t, opts)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(root, "a"), later, later)
+	if again := buildCheckSet(t, opts); !bytes.Equal(first, again) {
+		t.Error("checksets of the same tree differ")
+	}
+	opts.Compress = true
+	compressed := buildCheckSet(t, opts)
+	if again := buildCheckSet(t, opts); !bytes.Equal(compressed, again) {
+		t.Error("compressed checksets of the same tree differ")
+	}
+}
+
+// the directories create-update writes to aren't walked into the
+// release, even when they are under the root
+func TestOutputsNotWalked(t *testing.T) {
+	root := makeTree(t, map[string]string { "a": "1", "pub/old": "2", "patches/p": "3", "store/o": "4",
+		"rel.chk": "5", "rel.chk.index": "6" })
+	opts := testOptions(Source { root, "" })
+	opts.Publish = filepath.Join(root, "pub")
+	opts.PatchDir = filepath.Join(root, "patches")
+	opts.Store = filepath.Join(root, "store")
+	opts.Output = filepath.Join(root, "rel.chk")
+	opts.Index = filepath.Join(root, "rel.chk.index")
+	cset, _, err := MakeCheckSet(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cset) != 1 || cset["a"].Size != 1 {
+		t.Errorf("got %v, want only a", checkset.SortedNames(cset))
+	}
+	// but the root is walked even if it is one of them
+	opts.PatchDir = root
+	cset, _, err = MakeCheckSet(opts)
+	if err != nil || len(cset) != 2 {
+		t.Errorf("got %v, %v with patches in the root, want a and patches/p", checkset.SortedNames(cset), err)
+	}
+}
+
+func setTime(t *testing.T, name string, when time.Time) {
+	if err := os.Chtimes(name, when, when); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rewrite a file but leave its time as it was
+func rewrite(t *testing.T, name, content string) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setTime(t, name, fi.ModTime())
+}
+
+// hashes of files the index says are unchanged are reused, which shows
+// as a stale hash for a file rewritten behind the index's back
+func TestReuseHashes(t *testing.T) {
+	root := makeTree(t, map[string]string { "same": "aaaaaaaa", "newer": "bbbbbbbb", "resized": "cccccccc" })
+	before := time.Now().Add(-time.Hour)
+	setTime(t, filepath.Join(root, "same"), before)
+	setTime(t, filepath.Join(root, "resized"), before)
+	// modified after the index was started
+	setTime(t, filepath.Join(root, "newer"), time.Now().Add(time.Hour))
+	opts := testOptions(Source { root, "" })
+	first, tree, err := MakeCheckSet(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite(t, filepath.Join(root, "same"), "AAAAAAAA")
+	rewrite(t, filepath.Join(root, "newer"), "BBBBBBBB")
+	rewrite(t, filepath.Join(root, "resized"), "CCCCCC")
+	opts.Previous, opts.PreviousIndex = first, tree.Index
+	second, _, err := MakeCheckSet(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string { "same": "aaaaaaaa", "newer": "BBBBBBBB", "resized": "CCCCCC" }
+	for name, content := range want {
+		info := second[name]
+		if info.Hash != checkset.HashLink(content) || info.Size != int64(len(content)) {
+			t.Errorf("%s: got the hash of something other than %q", name, content)
+		}
+		if info.BlockSize != 2 || len(info.Blocks) != len(content) / 2 {
+			t.Errorf("%s: got %d blocks of %d", name, len(info.Blocks), info.BlockSize)
+		}
+	}
+	// blocks of another size can't be reused
+	opts.BlockSize = 4
+	third, _, err := MakeCheckSet(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := third["same"]
+	if same.Hash != checkset.HashLink("AAAAAAAA") || same.BlockSize != 4 || len(same.Blocks) != 2 {
+		t.Errorf("reused hashes of blocks of another size")
+	}
+}
+
+func TestSourceFlag(t *testing.T) {
+	good := map[string]Source {
+		"dir": { "dir", "" },
+		"dir=": { "dir", "" },
+		"dir=.": { "dir", "" },
+		"dir=lib/x/": { "dir", "lib/x" },
+		"dir=lib/./x": { "dir", "lib/x" },
+		"a=b=c": { "a=b", "c" },
+	}
+	for mapping, want := range good {
+		var sources SourceFlag
+		if err := sources.Set(mapping); err != nil || len(sources) != 1 || sources[0] != want {
+			t.Errorf("%s: got %v, %v; want %v", mapping, sources, err, want)
+		}
+	}
+	for _, mapping := range []string { "", "=lib", "dir=..", "dir=../lib", "dir=lib/../..", "dir=/lib", `dir=lib\x` } {
+		var sources SourceFlag
+		if err := sources.Set(mapping); err == nil {
+			t.Errorf("%s: accepted it as %v", mapping, sources)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// spec.go - rules saying which files go in a release, and how
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rspeele/check-update/checkset"
+	"github.com/rspeele/check-update/futility"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// a spec file holds one rule per line. blank lines and lines starting
+// with # are ignored.
+//
+//	match first|last
+//	include PATTERN [platform=PLATFORM] [mode=OCTAL] [+x] [-w] ...
+//	exclude PATTERN
+//
+// PATTERN is matched against paths in the release, as for
+// futility.Match, so **/*.exe matches executables at any depth. a
+// pattern containing spaces may be written as a Go string, in quotes.
+// excluding a directory leaves out everything in it, whatever later
+// rules say. since dir/** matches dir itself, keep some of the files in
+// a directory by excluding the rest with narrower patterns, such as
+// dir/**/*.o. PLATFORM is as for checkset.ParsePlatform. mode= sets the
+// permission bits of matching files, and +/- followed by any of rwx
+// adds or removes them for everyone, after mode= if both are given.
+//
+// a file is decided by the first rule it matches, unless "match last"
+// comes before any rules, in which case by the last. files no rule
+// matches are included for all platforms, as they are.
+
+// change to the permission bits of matching files
+type ModeChange struct {
+	Set bool // replace them with Perm, before Add and Drop
+	Perm os.FileMode
+	Add os.FileMode
+	Drop os.FileMode
+}
+
+func (change ModeChange) Apply(mode os.FileMode) os.FileMode {
+	if change.Set {
+		mode = mode &^ os.ModePerm | change.Perm
+	}
+	return (mode | change.Add) &^ change.Drop
+}
+
+type Spec struct {
+	Pattern string
+	Exclude bool
+	Target checkset.Platform
+	Mode ModeChange
+	Line int // in the file it came from
+}
+
+type Specs struct {
+	Rules []Spec
+	MatchLast bool
+}
+
+// the rule deciding name, a slash-separated path relative to the root,
+// or nil if none does
+func (specs Specs) Find(name string) *Spec {
+	var found *Spec
+	for i := range specs.Rules {
+		match, _ := futility.Match(specs.Rules[i].Pattern, name)
+		if match {
+			found = &specs.Rules[i]
+			if !specs.MatchLast {
+				break
+			}
+		}
+	}
+	return found
+}
+
+type SpecError struct {
+	File string
+	Line int
+	Err error
+}
+
+func (err *SpecError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Err)
+}
+
+func (err *SpecError) Unwrap() error {
+	return err.Err
+}
+
+// split a line into whitespace-separated words, unquoting quoted ones
+func specWords(line string) ([]string, error) {
+	var words []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return words, nil
+		}
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, errors.New("unterminated quoted pattern")
+			}
+			word, _ := strconv.Unquote(quoted)
+			if word == "" {
+				return nil, errors.New("empty quoted pattern")
+			}
+			words = append(words, word)
+			line = line[len(quoted):]
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		words = append(words, line[:end])
+		line = line[end:]
+	}
+}
+
+var permLetters = map[rune]os.FileMode { 'r': 0444, 'w': 0222, 'x': 0111 }
+
+func parseModeChange(change *ModeChange, word string) error {
+	if strings.HasPrefix(word, "mode=") {
+		perm, err := strconv.ParseUint(word[len("mode="):], 8, 32)
+		if err != nil || perm > uint64(os.ModePerm) {
+			return fmt.Errorf("bad mode %q; expected octal like 0755", word)
+		}
+		change.Set = true
+		change.Perm = os.FileMode(perm)
+		return nil
+	}
+	var bits os.FileMode
+	for _, c := range word[1:] {
+		bit, ok := permLetters[c]
+		if !ok {
+			return fmt.Errorf("bad mode change %q; expected + or - followed by any of rwx", word)
+		}
+		bits |= bit
+	}
+	if word == "+" || word == "-" {
+		return fmt.Errorf("bad mode change %q; expected + or - followed by any of rwx", word)
+	} else if word[0] == '+' {
+		change.Add |= bits
+	} else {
+		change.Drop |= bits
+	}
+	return nil
+}
+
+func parseSpecLine(words []string, spec *Spec) error {
+	if len(words) < 2 {
+		return errors.New("expected a pattern after " + words[0])
+	}
+	spec.Pattern = words[1]
+	spec.Exclude = words[0] == "exclude"
+	spec.Target = checkset.AllPlatforms
+	if err := futility.CheckPattern(spec.Pattern); err != nil {
+		return fmt.Errorf("bad pattern %q", spec.Pattern)
+	}
+	for _, word := range words[2:] {
+		switch {
+		case spec.Exclude:
+			return fmt.Errorf("unexpected %q; excluded files have no platform or mode", word)
+		case strings.HasPrefix(word, "platform="):
+			target, err := checkset.ParsePlatform(word[len("platform="):])
+			if err != nil {
+				return err
+			}
+			spec.Target = target
+		case strings.HasPrefix(word, "mode="), word[0] == '+', word[0] == '-':
+			if err := parseModeChange(&spec.Mode, word); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected %q", word)
+		}
+	}
+	return nil
+}
+
+// read a spec file from stream; name is used in errors
+func ReadSpecs(stream io.Reader, name string) (Specs, error) {
+	var specs Specs
+	scanner := bufio.NewScanner(stream)
+	for line := 1; scanner.Scan(); line++ {
+		fail := func(err error) (Specs, error) {
+			return specs, &SpecError { name, line, err }
+		}
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		words, err := specWords(text)
+		if err != nil {
+			return fail(err)
+		}
+		switch words[0] {
+		case "match":
+			if len(words) != 2 || (words[1] != "first" && words[1] != "last") {
+				return fail(errors.New("expected match first or match last"))
+			} else if len(specs.Rules) > 0 {
+				return fail(errors.New("match must come before any rules"))
+			}
+			specs.MatchLast = words[1] == "last"
+		case "include", "exclude":
+			spec := Spec { Line: line }
+			err = parseSpecLine(words, &spec)
+			if err != nil {
+				return fail(err)
+			}
+			specs.Rules = append(specs.Rules, spec)
+		default:
+			return fail(fmt.Errorf("unknown rule %q; expected include, exclude or match", words[0]))
+		}
+	}
+	return specs, scanner.Err()
+}
+
+func ReadSpecFile(name string) (Specs, error) {
+	if name == "-" {
+		return ReadSpecs(os.Stdin, "stdin")
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return Specs{}, err
+	}
+	defer file.Close()
+	return ReadSpecs(file, name)
+}
+
+// read the older pattern:platform lines, each of which is an include
+// rule, decided by the first match
+func ReadSpecific(stream io.Reader) (Specs, error) {
+	var specs Specs
+	scanner := bufio.NewScanner(stream)
+	for line := 1; scanner.Scan(); line++ {
+		split := strings.SplitN(strings.TrimRight(scanner.Text(), "\r"), ":", 2)
+		pat := split[0]
+		if pat == "" {
+			continue
+		}
+		pspec := ""
+		if len(split) > 1 {
+			pspec = split[1]
+		}
+		platform, err := checkset.ParsePlatform(pspec)
+		if err == nil {
+			err = futility.CheckPattern(pat)
+		}
+		if err != nil {
+			return specs, &SpecError { "stdin", line, err }
+		}
+		specs.Rules = append(specs.Rules, Spec { pat, false, platform, ModeChange{}, line })
+	}
+	return specs, scanner.Err()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"github.com/rspeele/check-update/checkset"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readSpecs(t *testing.T, text string) Specs {
+	specs, err := ReadSpecs(strings.NewReader(text), "test.spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return specs
+}
+
+// the line of the rule deciding name, or 0 if none does
+func decidingLine(specs Specs, name string) int {
+	if spec := specs.Find(name); spec != nil {
+		return spec.Line
+	}
+	return 0
+}
+
+const testSpec = `# comment
+
+include **/*.exe platform=windows +x
+exclude build/**
+include "docs/read me.txt" mode=0600 -w
+include **
+`
+
+func TestFindFirstMatch(t *testing.T) {
+	specs := readSpecs(t, testSpec)
+	tests := map[string]int {
+		"app.exe": 3,
+		"build/app.exe": 3, // decided before the exclude is reached
+		"build/app.o": 4,
+		"build": 4,
+		"docs/read me.txt": 5,
+		"docs/other.txt": 6,
+	}
+	for name, want := range tests {
+		if got := decidingLine(specs, name); got != want {
+			t.Errorf("%s decided by line %d, want %d", name, got, want)
+		}
+	}
+	if got := decidingLine(readSpecs(t, "include *.exe\n"), "app.o"); got != 0 {
+		t.Errorf("app.o decided by line %d, want none", got)
+	}
+}
+
+func TestFindLastMatch(t *testing.T) {
+	specs := readSpecs(t, "match last\n" + testSpec)
+	tests := map[string]int {
+		"app.exe": 7,
+		"build/app.exe": 7,
+		"build/app.o": 7,
+	}
+	for name, want := range tests {
+		if got := decidingLine(specs, name); got != want {
+			t.Errorf("%s decided by line %d, want %d", name, got, want)
+		}
+	}
+	specs = readSpecs(t, "match last\ninclude **\nexclude build/**\n")
+	if got := decidingLine(specs, "build/app.exe"); got != 3 {
+		t.Errorf("build/app.exe decided by line %d, want 3", got)
+	}
+}
+
+func TestReadSpecs(t *testing.T) {
+	specs := readSpecs(t, testSpec)
+	if len(specs.Rules) != 4 || specs.MatchLast {
+		t.Fatalf("read %d rules, match last %v", len(specs.Rules), specs.MatchLast)
+	}
+	exe := specs.Rules[0]
+	windows, _ := checkset.ParsePlatform("windows")
+	if exe.Pattern != "**/*.exe" || exe.Exclude || exe.Target != windows || exe.Mode.Add != 0111 {
+		t.Errorf("read %+v", exe)
+	}
+	if !specs.Rules[1].Exclude || specs.Rules[1].Target != checkset.AllPlatforms {
+		t.Errorf("read %+v", specs.Rules[1])
+	}
+	readme := specs.Rules[2]
+	if readme.Pattern != "docs/read me.txt" || readme.Mode.Apply(0755) != 0400 {
+		t.Errorf("read %+v, making 0755 %o", readme, readme.Mode.Apply(0755))
+	}
+	if specs.Rules[3].Mode.Apply(0755) != 0755 {
+		t.Errorf("rule without modes changes them")
+	}
+}
+
+func TestReadSpecsErrors(t *testing.T) {
+	tests := []struct {
+		text string
+		line int
+	} {
+		{ "include a\ninclud b\n", 2 },
+		{ "include\n", 1 },
+		{ "\n\ninclude [\n", 3 },
+		{ "include a\nmatch last\n", 2 },
+		{ "match sometimes\n", 1 },
+		{ "exclude a platform=windows\n", 1 },
+		{ "include a platform=plan9\n", 1 },
+		{ "include a mode=0999\n", 1 },
+		{ "include a mode=01000\n", 1 },
+		{ "include a +q\n", 1 },
+		{ "# ok\ninclude a -\n", 2 },
+		{ "include a b\n", 1 },
+		{ "include \"a b\n", 1 },
+		{ "include foo \"\"\n", 1 },
+		{ "\"\"\n", 1 },
+	}
+	for _, test := range tests {
+		_, err := ReadSpecs(strings.NewReader(test.text), "test.spec")
+		var specErr *SpecError
+		if !errors.As(err, &specErr) || specErr.File != "test.spec" || specErr.Line != test.line {
+			t.Errorf("%q: got %v, want an error on line %d", test.text, err, test.line)
+		}
+	}
+}
+
+func TestModeChange(t *testing.T) {
+	change := ModeChange { Set: true, Perm: 0640, Add: 0111, Drop: 0022 }
+	if got := change.Apply(os.ModeDir | 0777); got != os.ModeDir | 0751 {
+		t.Errorf("got %v", got)
+	}
+}
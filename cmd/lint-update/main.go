@@ -0,0 +1,57 @@
+// lint-update reports names in checksets that would break on some
+// clients, and exits with status 1 if it finds any
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/rspeele/check-update/checkset"
+	"log"
+	"os"
+)
+
+func LintFile(name string) ([]checkset.Problem, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, cset, err := checkset.Read(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	return checkset.Lint(cset), nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s checkset...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	failed := false
+	for _, name := range flag.Args() {
+		problems, err := LintFile(name)
+		if err != nil {
+			log.Printf("%s: %s", name, err)
+			failed = true
+			continue
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		failed = true
+		if flag.NArg() > 1 {
+			fmt.Printf("%s\n", name)
+		}
+		checkset.WriteProblems(os.Stdout, problems)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/rspeele/check-update/checkset"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCheckSet(t *testing.T, names ...string) string {
+	cset := make(checkset.CheckSet)
+	for _, name := range names {
+		cset[name] = checkset.CheckInfo {
+			Target: checkset.AllPlatforms,
+			Mode: 0644,
+			Hash: checkset.HashLink(name),
+			Size: int64(len(name)),
+		}
+	}
+	file, err := ioutil.TempFile("", "lint-update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(file.Name()) })
+	defer file.Close()
+	err = checkset.Write(checkset.Meta{}, cset, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestLintFile(t *testing.T) {
+	problems, err := LintFile(writeCheckSet(t, "bin/app", "readme.txt"))
+	if err != nil || len(problems) != 0 {
+		t.Errorf("got %v, %v for good names", problems, err)
+	}
+	problems, err = LintFile(writeCheckSet(t, "aux.txt", "Readme.txt", "readme.txt"))
+	if err != nil || len(problems) != 2 {
+		t.Errorf("got %v, %v; want two problems", problems, err)
+	}
+	if _, err = LintFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("linted a missing file")
+	}
+	garbage := filepath.Join(t.TempDir(), "garbage")
+	ioutil.WriteFile(garbage, []byte("not a checkset"), 0644)
+	if _, err = LintFile(garbage); err == nil {
+		t.Error("linted something that isn't a checkset")
+	}
+}
@@ -0,0 +1,269 @@
+// delta.go - binary patches from one version of a file to another
+
+// a patch is a magic number followed by a sequence of operations, each
+// either copying a range of the old file or inserting literal bytes,
+// ended by an end operation. everything is encoded in little-endian.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var Magic = [8]uint8{'R', 'S', 'P', 'D', 'E', 'L', 'T', 'A'}
+
+const (
+	opEnd = iota
+	opCopy // followed by CopyOp
+	opInsert // followed by InsertOp and that many bytes
+)
+
+type CopyOp struct {
+	Offset uint64
+	Length uint32
+}
+type InsertOp struct {
+	Length uint32
+}
+
+var BadMagic = errors.New("not a delta patch")
+var BadOp = errors.New("corrupt delta patch")
+
+// runs of new data are copied from the old file when a whole block of
+// at least minBlockSize bytes matches. blocks grow with the old file so
+// that no more than maxIndexed of them are remembered.
+const (
+	minBlockSize = 64
+	maxIndexed = 1<<20 // blocks of the old file to remember
+)
+
+// literal data is flushed in pieces no bigger than this
+const maxInsert = 1<<16
+
+func blockSizeFor(oldSize int64) int {
+	size := int64(minBlockSize)
+	for oldSize / size > maxIndexed {
+		size *= 2
+	}
+	return int(size)
+}
+
+// rolling checksum in the style of rsync
+type rolling struct {
+	a, b uint32
+	size uint32
+}
+
+func newRolling(block []byte) rolling {
+	roll := rolling { 0, 0, uint32(len(block)) }
+	for i, c := range block {
+		roll.a += uint32(c)
+		roll.b += uint32(len(block) - i) * uint32(c)
+	}
+	return roll
+}
+
+func (roll *rolling) roll(out, in byte) {
+	roll.a += uint32(in) - uint32(out)
+	roll.b += roll.a - roll.size * uint32(out)
+}
+
+func (roll *rolling) sum() uint32 {
+	return roll.b << 16 | roll.a & 0xffff
+}
+
+// offsets of blocks of old by checksum
+func index(old io.ReaderAt, oldSize int64, blockSize int) (map[uint32]int64, error) {
+	blocks := make(map[uint32]int64)
+	buf := make([]byte, blockSize)
+	for offset := int64(0); offset + int64(blockSize) <= oldSize; offset += int64(blockSize) {
+		_, err := old.ReadAt(buf, offset)
+		if err != nil {
+			return nil, err
+		}
+		sum := newRolling(buf)
+		if _, ok := blocks[sum.sum()]; !ok {
+			blocks[sum.sum()] = offset
+		}
+	}
+	return blocks, nil
+}
+
+// writes operations, merging adjacent copies
+type encoder struct {
+	out io.Writer
+	literal []byte
+	copying bool
+	copy CopyOp
+	err error
+}
+
+func (enc *encoder) write(op uint8, data interface{}) {
+	if enc.err != nil {
+		return
+	}
+	enc.err = binary.Write(enc.out, binary.LittleEndian, op)
+	if enc.err == nil && data != nil {
+		enc.err = binary.Write(enc.out, binary.LittleEndian, data)
+	}
+}
+
+func (enc *encoder) flushCopy() {
+	if enc.copying {
+		enc.write(opCopy, enc.copy)
+		enc.copying = false
+	}
+}
+
+func (enc *encoder) flushLiteral() {
+	if len(enc.literal) > 0 {
+		enc.write(opInsert, InsertOp { uint32(len(enc.literal)) })
+		if enc.err == nil {
+			_, enc.err = enc.out.Write(enc.literal)
+		}
+		enc.literal = enc.literal[:0]
+	}
+}
+
+func (enc *encoder) insert(c byte) {
+	enc.flushCopy()
+	enc.literal = append(enc.literal, c)
+	if len(enc.literal) >= maxInsert {
+		enc.flushLiteral()
+	}
+}
+
+func (enc *encoder) copyFrom(offset int64, length int) {
+	enc.flushLiteral()
+	if enc.copying && enc.copy.Offset + uint64(enc.copy.Length) == uint64(offset) &&
+		uint64(enc.copy.Length) + uint64(length) <= 0xffffffff {
+		enc.copy.Length += uint32(length)
+		return
+	}
+	enc.flushCopy()
+	enc.copy = CopyOp { uint64(offset), uint32(length) }
+	enc.copying = true
+}
+
+// fill buf from read, returning how much was read
+func fill(read io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(read, buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// write a patch to out which turns old, of oldSize bytes, into new
+func Diff(old io.ReaderAt, oldSize int64, new io.Reader, out io.Writer) error {
+	blockSize := blockSizeFor(oldSize)
+	blocks, err := index(old, oldSize, blockSize)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(Magic[:])
+	if err != nil {
+		return err
+	}
+	enc := &encoder { out: out }
+	read := bufio.NewReader(new)
+	// window over new, kept as a ring starting at start
+	window := make([]byte, blockSize)
+	line := make([]byte, blockSize) // window straightened out
+	candidate := make([]byte, blockSize)
+	n, err := fill(read, window)
+	if err != nil {
+		return err
+	}
+	start := 0
+	sum := newRolling(window[:n])
+	for n == blockSize && enc.err == nil {
+		if offset, ok := blocks[sum.sum()]; ok {
+			copy(line, window[start:])
+			copy(line[blockSize - start:], window[:start])
+			_, err = old.ReadAt(candidate, offset)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(line, candidate) {
+				enc.copyFrom(offset, blockSize)
+				n, err = fill(read, window)
+				if err != nil {
+					return err
+				}
+				start = 0
+				sum = newRolling(window[:n])
+				continue
+			}
+		}
+		c, err := read.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		drop := window[start]
+		enc.insert(drop)
+		window[start] = c
+		start = (start + 1) % blockSize
+		sum.roll(drop, c)
+	}
+	// what's left of the window never matched
+	for i := 0; i < n; i++ {
+		enc.insert(window[(start + i) % len(window)])
+	}
+	enc.flushLiteral()
+	enc.flushCopy()
+	enc.write(opEnd, nil)
+	return enc.err
+}
+
+// write the result of applying patch to old to out
+func Apply(old io.ReaderAt, patch io.Reader, out io.Writer) error {
+	read := bufio.NewReader(patch)
+	var magic [8]uint8
+	_, err := io.ReadFull(read, magic[:])
+	if err != nil || magic != Magic {
+		return BadMagic
+	}
+	for {
+		op, err := read.ReadByte()
+		if err != nil {
+			return BadOp
+		}
+		switch op {
+		case opEnd:
+			return nil
+		case opCopy:
+			var cp CopyOp
+			err = binary.Read(read, binary.LittleEndian, &cp)
+			if err != nil {
+				return BadOp
+			}
+			section := io.NewSectionReader(old, int64(cp.Offset), int64(cp.Length))
+			copied, err := io.Copy(out, section)
+			if err != nil {
+				return err
+			} else if copied != int64(cp.Length) {
+				return BadOp // patch is for a different old file
+			}
+		case opInsert:
+			var ins InsertOp
+			err = binary.Read(read, binary.LittleEndian, &ins)
+			if err != nil {
+				return BadOp
+			}
+			_, err = io.CopyN(out, read, int64(ins.Length))
+			if err == io.EOF {
+				return BadOp
+			} else if err != nil {
+				return err
+			}
+		default:
+			return BadOp
+		}
+	}
+}
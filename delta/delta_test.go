@@ -0,0 +1,133 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func diff(t *testing.T, old, new []byte) []byte {
+	var patch bytes.Buffer
+	err := Diff(bytes.NewReader(old), int64(len(old)), bytes.NewReader(new), &patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patch.Bytes()
+}
+
+func apply(old, patch []byte) ([]byte, error) {
+	var out bytes.Buffer
+	err := Apply(bytes.NewReader(old), bytes.NewReader(patch), &out)
+	return out.Bytes(), err
+}
+
+// the operations in a patch, as their codes and lengths
+func ops(t *testing.T, patch []byte) ([]uint8, []uint32) {
+	read := bufio.NewReader(bytes.NewReader(patch[len(Magic):]))
+	var codes []uint8
+	var lengths []uint32
+	for {
+		op, err := read.ReadByte()
+		if err != nil {
+			t.Fatal("patch has no end")
+		}
+		codes = append(codes, op)
+		switch op {
+		case opEnd:
+			return codes, lengths
+		case opCopy:
+			var cp CopyOp
+			binary.Read(read, binary.LittleEndian, &cp)
+			lengths = append(lengths, cp.Length)
+		case opInsert:
+			var ins InsertOp
+			binary.Read(read, binary.LittleEndian, &ins)
+			read.Discard(int(ins.Length))
+			lengths = append(lengths, ins.Length)
+		default:
+			t.Fatalf("bad op %d", op)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	base := randomBytes(1, 10000)
+	inserted := append(append(append([]byte{}, base[:5000]...), "inserted"...), base[5000:]...)
+	cases := []struct {
+		name string
+		old, new []byte
+	} {
+		{ "both empty", nil, nil },
+		{ "empty old", nil, base },
+		{ "empty new", base, nil },
+		{ "same", base, base },
+		{ "shorter than a block", []byte("old"), []byte("new") },
+		{ "new shorter than a block", base, base[:10] },
+		{ "shifted", base, append([]byte("xyz"), base...) },
+		{ "inserted", base, inserted },
+		{ "truncated", base, base[:7777] },
+		{ "unrelated", base, randomBytes(2, 10000) },
+	}
+	for _, c := range cases {
+		patch := diff(t, c.old, c.new)
+		got, err := apply(c.old, patch)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !bytes.Equal(got, c.new) {
+			t.Errorf("%s: patched to %d bytes, not the %d of new", c.name, len(got), len(c.new))
+		}
+	}
+}
+
+// data that mostly matches is mostly copied
+func TestShiftedIsCopied(t *testing.T) {
+	base := randomBytes(3, 100000)
+	patch := diff(t, base, append([]byte("xyz"), base...))
+	if len(patch) > 1000 {
+		t.Errorf("patch for a 3 byte shift is %d bytes", len(patch))
+	}
+}
+
+func TestInsertSplit(t *testing.T) {
+	new := randomBytes(4, 2 * maxInsert + 10)
+	codes, lengths := ops(t, diff(t, nil, new))
+	want := []uint32 { maxInsert, maxInsert, 10 }
+	if len(lengths) != len(want) {
+		t.Fatalf("got lengths %v, want %v", lengths, want)
+	}
+	for i := range want {
+		if codes[i] != opInsert || lengths[i] != want[i] {
+			t.Errorf("op %d: got %d of %d bytes, want insert of %d", i, codes[i], lengths[i], want[i])
+		}
+	}
+}
+
+func TestApplyCorrupt(t *testing.T) {
+	old := randomBytes(5, 10000)
+	new := append(append([]byte{}, old[:3000]...), randomBytes(6, 500)...)
+	patch := diff(t, old, new)
+	if _, err := apply(old, []byte("RSPDELTX")); err != BadMagic {
+		t.Errorf("bad magic: got %v", err)
+	}
+	for cut := len(Magic); cut < len(patch); cut += 97 {
+		if _, err := apply(old, patch[:cut]); err != BadOp {
+			t.Errorf("cut at %d of %d: got %v, want BadOp", cut, len(patch), err)
+		}
+	}
+	bad := append(append([]byte{}, patch[:len(Magic)]...), 9)
+	if _, err := apply(old, bad); err != BadOp {
+		t.Errorf("unknown op: got %v, want BadOp", err)
+	}
+	// a patch for a longer old file copies past the end of this one
+	if _, err := apply(old[:1000], patch); err != BadOp {
+		t.Errorf("short old file: got %v, want BadOp", err)
+	}
+}
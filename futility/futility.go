@@ -3,6 +3,7 @@ package futility
 import "path/filepath"
 import "os"
 import "io"
+import "errors"
 
 var selfPath string
 func RecordSelfPath() error {
@@ -94,20 +95,51 @@ type StatFile struct {
 func NoFilter(sf StatFile) bool {
 	return true
 }
-func Recurse(root string, filter func(StatFile) bool, files chan StatFile) {
-	walker := func(path string, info os.FileInfo, err error) error {
-		if err == nil {
-			sf := StatFile { path, info }
-			if filter(sf) {
-				files <- StatFile { path, info }
-			} else {
-				return filepath.SkipDir
+// send root and everything under it that passes filter to files, leaving
+// out whatever IgnoreFile files say to, and the files themselves. if
+// ignored isn't nil, what is left out that way is sent to it. a
+// directory left out either way is not descended into. closes files
+// and ignored when done, returning the first error walking the tree.
+func Recurse(root string, filter func(StatFile) bool, files chan StatFile, ignored chan StatFile) error {
+	ign := make(ignorer)
+	walker := func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		sf := StatFile { name, info }
+		skip := error(nil)
+		if info.IsDir() {
+			skip = filepath.SkipDir
+		} // SkipDir on a file would skip the rest of its directory
+		if rel != "." && ign.ignored(rel, info.IsDir()) {
+			if ignored != nil {
+				ignored <- sf
 			}
+			return skip
 		}
-		return err
+		if !filter(sf) {
+			return skip
+		}
+		if info.IsDir() {
+			err = ign.load(rel, name)
+			if err != nil {
+				return err
+			}
+		}
+		files <- sf
+		return nil
 	}
-	filepath.Walk(root, walker)
+	err := filepath.Walk(root, walker)
 	close(files)
+	if ignored != nil {
+		close(ignored)
+	}
+	return err
 }
 
 // try hard to create a file with MODE at PATH. creates any missing
@@ -121,7 +153,7 @@ func Create(path string, mode os.FileMode) (*os.File, error) {
 	}
 	var wr *os.File
 	for tries := 0; tries < 2; tries++ {
-		wr, err = os.OpenFile(path, os.O_CREATE | os.O_WRONLY, mode)
+		wr, err = os.OpenFile(path, os.O_CREATE | os.O_WRONLY | os.O_TRUNC, mode)
 		// sometimes, can't overwrite a file, but can move it out of the way
 		if err != nil {
 			trash := path + ".trash"
@@ -142,3 +174,37 @@ func Create(path string, mode os.FileMode) (*os.File, error) {
 	return wr, err
 
 }
+
+// rename FROM over TO, moving TO out of the way first if it can't be
+// replaced directly
+func Replace(from string, to string) error {
+	err := os.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+	trash := to + ".trash"
+	os.Remove(trash)
+	if os.Rename(to, trash) != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+var UnknownFreeSpace = errors.New("can't tell free space on this platform")
+
+// bytes available to us on the filesystem holding PATH, which need not
+// exist yet
+func FreeSpace(path string) (uint64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	for !PathExists(path, os.ModeDir) {
+		parent := filepath.Dir(path)
+		if parent == path {
+			break
+		}
+		path = parent
+	}
+	return freeSpace(path)
+}
@@ -0,0 +1,47 @@
+package futility
+
+import (
+	"path"
+	"strings"
+)
+
+// reports whether name, a slash-separated path, matches pattern. pattern
+// is as for path.Match, except that a path element of ** matches any
+// number of path elements, including none.
+func Match(pattern, name string) (bool, error) {
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElements(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for skip := 0; skip <= len(name); skip++ {
+				match, err := matchElements(pattern[1:], name[skip:])
+				if match || err != nil {
+					return match, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		match, err := path.Match(pattern[0], name[0])
+		if !match || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// returns path.ErrBadPattern if pattern is malformed, whatever it's
+// matched against
+func CheckPattern(pattern string) error {
+	for _, element := range strings.Split(pattern, "/") {
+		if _, err := path.Match(element, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
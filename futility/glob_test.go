@@ -0,0 +1,59 @@
+package futility
+
+import (
+	"path"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match bool
+	} {
+		{ "*.go", "main.go", true },
+		{ "*.go", "cmd/main.go", false }, // * stays within an element
+		{ "cmd/*", "cmd/main.go", true },
+		{ "cmd/*", "cmd", false },
+		{ "cmd/*", "cmd/x/main.go", false },
+		{ "c?d/[a-m]*", "cmd/main.go", true },
+		{ "**", "a", true },
+		{ "**", "a/b/c", true },
+		{ "**/*.exe", "x.exe", true }, // ** may match nothing
+		{ "**/*.exe", "bin/x.exe", true },
+		{ "**/*.exe", "bin/win/x.exe", true },
+		{ "**/*.exe", "bin/x.exe/y", false },
+		{ "dir/**", "dir", true },
+		{ "dir/**", "dir/a/b", true },
+		{ "dir/**", "dirt/a", false },
+		{ "a/**/b", "a/b", true },
+		{ "a/**/b", "a/x/y/b", true },
+		{ "a/**/b", "a/x/y/c", false },
+		{ "a/**/b", "x/a/b", false },
+		{ "**/b/**", "a/b/c", true },
+		{ "**/b/**", "b", true },
+		{ "a/**b", "a/xb", true }, // only a whole element of ** is special
+		{ "a/**b", "a/x/b", false },
+		{ "main.go", "main.go/x", false },
+		{ "a/b", "a", false },
+	}
+	for _, test := range tests {
+		match, err := Match(test.pattern, test.name)
+		if err != nil || match != test.match {
+			t.Errorf("Match(%q, %q) = %v, %v; want %v", test.pattern, test.name, match, err, test.match)
+		}
+	}
+}
+
+func TestBadPattern(t *testing.T) {
+	for _, pattern := range []string { "[", "a/[b", "**/x[" } {
+		if CheckPattern(pattern) != path.ErrBadPattern {
+			t.Errorf("CheckPattern(%q) accepted it", pattern)
+		}
+		if _, err := Match(pattern, "a/b/x"); err != path.ErrBadPattern {
+			t.Errorf("Match(%q) gave %v", pattern, err)
+		}
+	}
+	if CheckPattern("a/**/[bc]*.o") != nil {
+		t.Error("CheckPattern rejected a good pattern")
+	}
+}
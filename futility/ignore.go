@@ -0,0 +1,116 @@
+package futility
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// files listing what Recurse should leave out, in the syntax of
+// .gitignore. each applies to the directory it is in and everything
+// under it, with the rules of deeper files taking precedence.
+const IgnoreFile = ".checkignore"
+
+type ignoreRule struct {
+	pattern string // as for Match, relative to the ignore file's directory
+	negate bool
+	dirOnly bool
+}
+
+// parse a line of an ignore file, returning false if it has no rule
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	var rule ignoreRule
+	line = strings.TrimRight(line, "\r")
+	// trailing spaces don't count, unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line) - 1]
+	}
+	if line == "" || line[0] == '#' {
+		return rule, false
+	}
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+	// a pattern with no slash but at its end matches at any depth
+	if strings.HasPrefix(line, "/") {
+		line = line[1:]
+	} else if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	if CheckPattern(line) != nil {
+		return rule, false // as git does, ignore rules that can't match
+	}
+	rule.pattern = line
+	return rule, true
+}
+
+func readIgnoreFile(name string) ([]ignoreRule, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// rules of the ignore files found so far, by the slash-separated path
+// of their directory relative to the root
+type ignorer map[string][]ignoreRule
+
+func (ign ignorer) load(rel, dir string) error {
+	rules, err := readIgnoreFile(filepath.Join(dir, IgnoreFile))
+	if len(rules) > 0 {
+		ign[rel] = rules
+	}
+	return err
+}
+
+// whether rel, a slash-separated path relative to the root, is ignored
+func (ign ignorer) ignored(rel string, dir bool) bool {
+	if path.Base(rel) == IgnoreFile && !dir {
+		return true
+	}
+	// directories from the root down, so deeper rules win
+	var dirs []string
+	for d := path.Dir(rel); ; d = path.Dir(d) {
+		dirs = append(dirs, d)
+		if d == "." {
+			break
+		}
+	}
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		under := rel
+		if dirs[i] != "." {
+			under = rel[len(dirs[i]) + 1:]
+		}
+		for _, rule := range ign[dirs[i]] {
+			if rule.dirOnly && !dir {
+				continue
+			}
+			if match, _ := Match(rule.pattern, under); match {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
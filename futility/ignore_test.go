@@ -0,0 +1,138 @@
+package futility
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// an ignorer with the rules in files, keyed by the slash-separated
+// directory each is in
+func testIgnorer(files map[string]string) ignorer {
+	ign := make(ignorer)
+	for dir, text := range files {
+		for _, line := range strings.Split(text, "\n") {
+			if rule, ok := parseIgnoreRule(line); ok {
+				ign[dir] = append(ign[dir], rule)
+			}
+		}
+	}
+	return ign
+}
+
+func TestIgnored(t *testing.T) {
+	ign := testIgnorer(map[string]string {
+		".": "# comment\n*.log\n!keep.log\n/top.txt\nbuild/\nsub/*.o\n\\#hash\ntrailing   \nescaped\\ \n",
+		"sub": "!*.log\nlocal.txt\n/anchored\n",
+	})
+	tests := []struct {
+		name string
+		dir bool
+		ignored bool
+	} {
+		{ "a.log", false, true },
+		{ "deep/er/a.log", false, true }, // no slash matches at any depth
+		{ "keep.log", false, false }, // negated after
+		{ "deep/keep.log", false, false },
+		{ "top.txt", false, true },
+		{ "deep/top.txt", false, false }, // anchored by a leading slash
+		{ "build", true, true },
+		{ "build", false, false }, // only directories
+		{ "deep/build", true, true },
+		{ "sub/a.o", false, true }, // a slash anchors it too
+		{ "deep/sub/a.o", false, false },
+		{ "sub/deep/a.o", false, false },
+		{ "#hash", false, true },
+		{ "trailing", false, true },
+		{ "escaped ", false, true },
+		{ "escaped", false, false },
+		{ "sub/a.log", false, false }, // the deeper file wins
+		{ "sub/deep/a.log", false, false },
+		{ "sub/local.txt", false, true },
+		{ "sub/deep/local.txt", false, true },
+		{ "local.txt", false, false }, // rules only apply under their file
+		{ "sub/anchored", false, true },
+		{ "sub/deep/anchored", false, false },
+		{ "anchored", false, false },
+		{ IgnoreFile, false, true },
+		{ "sub/" + IgnoreFile, false, true },
+	}
+	for _, test := range tests {
+		if got := ign.ignored(test.name, test.dir); got != test.ignored {
+			t.Errorf("%s (dir %v): ignored %v, want %v", test.name, test.dir, got, test.ignored)
+		}
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	for _, line := range []string { "", "   ", "# comment", "!", "/", "[" } {
+		if rule, ok := parseIgnoreRule(line); ok {
+			t.Errorf("%q parsed as %+v", line, rule)
+		}
+	}
+}
+
+func TestRecurseIgnores(t *testing.T) {
+	root, err := ioutil.TempDir("", "futility")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string {
+		IgnoreFile: "*.tmp\nout/\n",
+		"a.tmp": "",
+		"b.txt": "",
+		"out/c.txt": "",
+		"sub/" + IgnoreFile: "!*.tmp\nd.txt\n",
+		"sub/c.tmp": "",
+		"sub/d.txt": "",
+		"sub/e.txt": "",
+	}
+	for name, content := range files {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(full), 0755)
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walked := make(chan StatFile)
+	ignored := make(chan StatFile)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Recurse(root, NoFilter, walked, ignored)
+	}()
+	var kept, left []string
+	rel := func(sf StatFile) string {
+		name, _ := filepath.Rel(root, sf.Name)
+		return filepath.ToSlash(name)
+	}
+	for walked != nil || ignored != nil {
+		select {
+		case sf, ok := <-walked:
+			if !ok {
+				walked = nil
+			} else {
+				kept = append(kept, rel(sf))
+			}
+		case sf, ok := <-ignored:
+			if !ok {
+				ignored = nil
+			} else {
+				left = append(left, rel(sf))
+			}
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(left)
+	// out/c.txt isn't reached, as out is left out whole
+	wantKept := ". b.txt sub sub/c.tmp sub/e.txt"
+	wantLeft := IgnoreFile + " a.tmp out sub/" + IgnoreFile + " sub/d.txt"
+	if strings.Join(kept, " ") != wantKept || strings.Join(left, " ") != wantLeft {
+		t.Errorf("kept %v and left out %v", kept, left)
+	}
+}
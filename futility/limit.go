@@ -0,0 +1,69 @@
+package futility
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// shares a rate of bytes per second between any number of readers
+type Limiter struct {
+	lock sync.Mutex
+	rate int64
+	next time.Time // when everything granted so far will have been read at rate
+}
+
+// how far ahead of schedule readers may get, so that short pauses in
+// reading aren't made up for with bursts
+const limiterSlack = 250 * time.Millisecond
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter { rate: rate }
+}
+
+// wait until reading n more bytes keeps within the rate
+func (limiter *Limiter) Wait(n int) {
+	limiter.lock.Lock()
+	now := time.Now()
+	if limiter.next.Before(now.Add(-limiterSlack)) {
+		limiter.next = now.Add(-limiterSlack)
+	}
+	limiter.next = limiter.next.Add(time.Duration(int64(n) * int64(time.Second) / limiter.rate))
+	wait := limiter.next.Sub(now)
+	limiter.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type limitedReader struct {
+	stream io.ReadCloser
+	limiter *Limiter
+}
+
+func (read *limitedReader) Read(p []byte) (int, error) {
+	// read in small pieces so that waits are short and readers sharing
+	// the limiter take turns
+	chunk := int(read.limiter.rate / 10) + 1
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := read.stream.Read(p)
+	if n > 0 {
+		read.limiter.Wait(n)
+	}
+	return n, err
+}
+
+func (read *limitedReader) Close() error {
+	return read.stream.Close()
+}
+
+// returns stream read no faster than the limiter allows. a nil limiter
+// doesn't limit.
+func (limiter *Limiter) Reader(stream io.ReadCloser) io.ReadCloser {
+	if limiter == nil {
+		return stream
+	}
+	return &limitedReader { stream, limiter }
+}
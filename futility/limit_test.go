@@ -0,0 +1,50 @@
+package futility
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// time to read total bytes through readers sharing a limiter of rate
+func timeReads(rate int64, readers int, total int) time.Duration {
+	limiter := NewLimiter(rate)
+	var wait sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < readers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			read := limiter.Reader(io.NopCloser(bytes.NewReader(make([]byte, total / readers))))
+			io.Copy(io.Discard, read)
+		}()
+	}
+	wait.Wait()
+	return time.Since(start)
+}
+
+func TestLimiterRate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a second")
+	}
+	const rate = 400000
+	const total = 300000
+	// readers may start limiterSlack ahead of schedule
+	want := time.Duration(total) * time.Second / rate - limiterSlack
+	for _, readers := range []int { 1, 4 } {
+		took := timeReads(rate, readers, total)
+		if took < want * 9 / 10 || took > want * 2 {
+			t.Errorf("%d readers took %v to read %d bytes at %d a second, want about %v", readers, took, total, rate, want)
+		}
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var limiter *Limiter
+	stream := io.NopCloser(bytes.NewReader(nil))
+	if limiter.Reader(stream) != stream {
+		t.Error("nil limiter wrapped the stream")
+	}
+}
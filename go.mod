@@ -0,0 +1,3 @@
+module github.com/rspeele/check-update
+
+go 1.20
@@ -0,0 +1,85 @@
+// http.go - retrieving releases from a web server
+
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rspeele/check-update/checkset"
+	"github.com/rspeele/check-update/futility"
+	"io"
+	"net/http"
+)
+
+// a release published under the URL Base, which usually ends in a slash
+type HTTP struct {
+	Base string
+	Client *http.Client // nil for http.DefaultClient
+	Limit *futility.Limiter // shared by all downloads; nil if they aren't limited
+}
+
+func (server HTTP) do(ctx context.Context, method, name string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, server.Base + name, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := server.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// a checkset.Retriever
+func (server HTTP) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := server.do(ctx, "GET", name, nil)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		// accept no HTTP errors
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return server.Limit.Reader(resp.Body), nil
+}
+
+// a checkset.RangeRetriever
+func (server HTTP) Range(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset + length - 1))
+	resp, err := server.do(ctx, "GET", name, header)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode == http.StatusOK {
+		// server ignored the range and is sending the whole file
+		resp.Body.Close()
+		return nil, checkset.NoRanges
+	} else if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+	return server.Limit.Reader(resp.Body), nil
+}
+
+// for Options.Size
+func (server HTTP) Size(ctx context.Context, name string) (int64, error) {
+	resp, err := server.do(ctx, "HEAD", name, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(resp.Status)
+	} else if resp.ContentLength < 0 {
+		return 0, errors.New("server did not say how big " + server.Base + name + " is")
+	}
+	return resp.ContentLength, nil
+}
+
+func (server HTTP) Source() checkset.Source {
+	return checkset.Source { Get: server.Get, Range: server.Range }
+}
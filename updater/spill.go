@@ -0,0 +1,101 @@
+// spill.go - bad files kept on disk between verifying and resolving
+
+package updater
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"github.com/rspeele/check-update/checkset"
+	"io"
+	"os"
+)
+
+// a checkset.BadFile as gob can encode it
+type spilledBad struct {
+	Remote string
+	Local string
+	Info checkset.CheckInfo
+	Reason int
+	Err string
+}
+
+// a temporary file of bad files, so that a fresh install doesn't hold
+// the whole checkset in memory until it has all been verified
+type spill struct {
+	file *os.File
+	buffer *bufio.Writer
+	enc *gob.Encoder
+	count int
+}
+
+func newSpill() (*spill, error) {
+	file, err := os.CreateTemp("", "check-update-*")
+	if err != nil {
+		return nil, err
+	}
+	buffer := bufio.NewWriter(file)
+	return &spill { file, buffer, gob.NewEncoder(buffer), 0 }, nil
+}
+
+func (bads *spill) add(bad checkset.BadFile) error {
+	spilled := spilledBad { bad.Remote, bad.Local, bad.Info, bad.Reason, "" }
+	if bad.Err != nil {
+		spilled.Err = bad.Err.Error()
+	}
+	bads.count++
+	return bads.enc.Encode(spilled)
+}
+
+// send everything added to out, in order, then close it. stops early
+// when ctx is done.
+func (bads *spill) send(ctx context.Context, out chan checkset.BadFile) error {
+	defer close(out)
+	return bads.each(0, func(bad checkset.BadFile) error {
+		select {
+		case out <- bad:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// call fn with everything added, in order, from the skip'th on. stops
+// at the first error fn returns.
+func (bads *spill) each(skip int, fn func(checkset.BadFile) error) error {
+	err := bads.buffer.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = bads.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	dec := gob.NewDecoder(bufio.NewReader(bads.file))
+	for i := 0; i < bads.count; i++ {
+		var spilled spilledBad
+		err = dec.Decode(&spilled)
+		if err != nil {
+			return err
+		}
+		bad := checkset.BadFile { Remote: spilled.Remote, Local: spilled.Local, Info: spilled.Info, Reason: spilled.Reason }
+		if spilled.Err != "" {
+			bad.Err = errors.New(spilled.Err)
+		}
+		if i < skip {
+			continue
+		}
+		err = fn(bad)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bads *spill) remove() {
+	bads.file.Close()
+	os.Remove(bads.file.Name())
+}
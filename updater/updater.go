@@ -0,0 +1,411 @@
+// updater.go - bring a local directory up to date with a published release
+
+// package updater verifies a local copy of a release against its
+// checkset and fetches whatever is out of date, for embedding in
+// launchers. the check-update command is a thin wrapper around it.
+package updater
+
+import (
+	"context"
+	"fmt"
+	"github.com/rspeele/check-update/checkset"
+	"github.com/rspeele/check-update/futility"
+	"io"
+	"log"
+	"time"
+)
+
+// bump when the updater learns to handle a new kind of release
+// 1: the first
+// 2: files fetched by hash, for checkset.ContentLayout
+// 3: platforms telling unix-like OSes and newer arches apart
+const Version = 3
+
+// oldest Version able to apply the release cset with meta, for
+// Meta.MinUpdater; 0 if any will do
+func RequiredVersion(meta checkset.Meta, cset checkset.CheckSet) uint16 {
+	for _, info := range cset {
+		if !checkset.IsNarrow(info.Target) {
+			return 3
+		}
+	}
+	if meta.Layout != checkset.PathLayout {
+		return 2
+	}
+	return 0
+}
+
+type Options struct {
+	// where the checkset and release files come from. see HTTP for
+	// fetching them from a web server.
+	Source checkset.Source
+	CheckSet string // remote name of the checkset
+	Local string // directory to bring up to date
+	Store checkset.Store // optional; see checkset.Store
+
+	// remote size of a file, for checking there is room for the
+	// update. if nil, disk space isn't checked.
+	Size func(ctx context.Context, name string) (int64, error)
+
+	// where to say what is going on; nil for silence
+	Logger *log.Logger
+	// gets a new Progress whenever anything happens; optional
+	Progress func(checkset.Progress)
+
+	// policy hooks, all optional.
+	// decides whether this updater can handle the release, given
+	// its metadata. defaults to CheckMeta.
+	CheckMeta func(checkset.Meta) error
+	// decides whether a bad file should be fixed. skipped files are
+	// left alone and don't appear in the Result.
+	Filter func(checkset.BadFile) bool
+	// called with the Found and Bytes of the Result once everything
+	// has been verified and before anything is changed. returning an
+	// error stops the update there.
+	Confirm func(Result) error
+}
+
+// what became of a file found bad and not fixed
+const (
+	Pending = iota // not attempted, because the update stopped first
+	Failed // couldn't be fixed; see FileResult.Err
+)
+
+type FileResult struct {
+	Bad checkset.BadFile
+	Status int
+	Err error
+}
+
+// only the files that weren't fixed are kept, since on a fresh install
+// every file is bad
+type Result struct {
+	Meta checkset.Meta
+	Found int // files found bad, not counting those skipped
+	Bytes int64 // to download for those, not counting those of unknown size
+	Files []FileResult // those found that weren't fixed, in the order found
+	updated int
+}
+
+// files to try again, having failed or not been attempted
+func (result Result) Failed() []checkset.BadFile {
+	var bads []checkset.BadFile
+	for _, file := range result.Files {
+		bads = append(bads, file.Bad)
+	}
+	return bads
+}
+
+// number of files that were fixed
+func (result Result) Updated() int {
+	return result.updated
+}
+
+// the errors of files that failed
+func (result Result) Err() error {
+	var errs checkset.FileErrors
+	for _, file := range result.Files {
+		if file.Status == Failed {
+			errs = append(errs, &checkset.FileError { Name: file.Bad.Remote, Err: file.Err })
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func DescribeReason(reason int) string {
+	switch reason {
+	case checkset.Valid:
+		return "valid (this is a bug, but probably harmless)"
+	case checkset.Missing:
+		return "missing"
+	case checkset.HashMismatch:
+		return "outdated"
+	case checkset.TypeMismatch:
+		return "wrong file type"
+	case checkset.PermMismatch:
+		return "permissions"
+	case checkset.Unreadable:
+		return "unreadable"
+	}
+	return "unknown reason (this is a bug)"
+}
+
+func FormatSize(size int64) string {
+	const KB = 1024
+	const MB = 1024*KB
+	switch {
+	case size == checkset.UnknownSize:
+		return "unknown size"
+	case size >= MB:
+		return fmt.Sprintf("%.1f MB", float64(size) / MB)
+	case size >= KB:
+		return fmt.Sprintf("%.1f KB", float64(size) / KB)
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// the default Options.CheckMeta
+func CheckMeta(meta checkset.Meta) error {
+	if meta.MinUpdater > Version {
+		return fmt.Errorf("this update requires updater version %d or newer, but this is version %d; please download a new updater", meta.MinUpdater, Version)
+	}
+	if meta.Layout != checkset.PathLayout && meta.Layout != checkset.ContentLayout {
+		return fmt.Errorf("this update uses an unknown server layout %q; please download a new updater", meta.Layout)
+	}
+	return nil
+}
+
+func showMeta(logger *log.Logger, meta checkset.Meta) {
+	if meta.Release != "" {
+		logger.Printf("release %s", meta.Release)
+	}
+	if meta.Channel != "" {
+		logger.Printf("channel %s", meta.Channel)
+	}
+	if !meta.Built.IsZero() {
+		logger.Printf("built %s", meta.Built.Format(time.RFC1123))
+	}
+	for k, v := range meta.Extra {
+		logger.Printf("%s: %s", k, v)
+	}
+}
+
+// bytes to download to resolve bad; files of unknown size count as 0
+func badSize(bad checkset.BadFile) int64 {
+	if bad.Reason == checkset.PermMismatch || bad.Info.Size < 0 {
+		return 0 // nothing to download
+	}
+	return bad.Info.Size
+}
+
+// logs the bad files and keeps them in bads, skipping those that don't
+// pass filter, and counts them in tracker. when opts.Size is set,
+// totals the space they need. failing to get a size doesn't stop the
+// rest being kept, so that they can all be given as Pending.
+func collectBad(ctx context.Context, opts Options, src checkset.Source, in chan checkset.BadFile, bads *spill, space *checkset.Space, result *Result, tracker *checkset.Tracker) error {
+	var failed error
+	broken := false // bads can't take any more
+	remoteSize := func(bad checkset.BadFile) (int64, error) {
+		return opts.Size(ctx, src.RemotePath(bad.Remote, bad.Info))
+	}
+	for bad := range in {
+		if broken || opts.Filter != nil && !opts.Filter(bad) {
+			continue // drain in, so that verifying can finish
+		}
+		tracker.Found(bad)
+		why := DescribeReason(bad.Reason)
+		if bad.Err != nil {
+			why += " (" + bad.Err.Error() + ")"
+		}
+		size := bad.Info.Size
+		if bad.Reason == checkset.PermMismatch {
+			size = 0
+		}
+		opts.Logger.Printf("%-40s %-12s %s", bad.Remote, why, FormatSize(size))
+		result.Found++
+		result.Bytes += badSize(bad)
+		err := bads.add(bad)
+		if err != nil {
+			failed, broken = err, true
+		} else if failed == nil && opts.Size != nil {
+			failed = space.Add(bad, remoteSize)
+		}
+	}
+	return failed
+}
+
+// add the files kept in bads, from the skip'th on, to result as Pending,
+// for when the update stops before getting to them
+func pending(opts Options, bads *spill, skip int, result *Result) {
+	if skip >= bads.count {
+		return
+	}
+	err := bads.each(skip, func(bad checkset.BadFile) error {
+		result.Files = append(result.Files, FileResult { bad, Pending, nil })
+		return nil
+	})
+	if err != nil {
+		opts.Logger.Printf("can't list the files not updated: %s", err)
+	}
+}
+
+// make sure the disk holding the local directory, or the store if there
+// is one, has room for all the files to be fetched
+func checkSpace(opts Options, src checkset.Source, space checkset.Space) error {
+	needed := space.Needed()
+	disk := opts.Local
+	if src.Store != "" {
+		disk = string(src.Store)
+	}
+	free, err := futility.FreeSpace(disk)
+	if err != nil {
+		opts.Logger.Printf("not checking for disk space: %s", err)
+		return nil
+	}
+	if uint64(needed) > free {
+		return fmt.Errorf("not enough disk space for this update: it needs %s, but only %s is free for %s",
+			FormatSize(needed), FormatSize(int64(free)), disk)
+	}
+	return nil
+}
+
+func withDefaults(opts Options) Options {
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	if opts.CheckMeta == nil {
+		opts.CheckMeta = CheckMeta
+	}
+	return opts
+}
+
+func newTracker(opts Options) *checkset.Tracker {
+	if opts.Progress == nil {
+		return nil
+	}
+	return checkset.NewTracker(opts.Progress)
+}
+
+// where to get the files of the release with meta
+func source(opts Options, meta checkset.Meta) checkset.Source {
+	src := opts.Source
+	src.ByHash = meta.Layout == checkset.ContentLayout
+	src.Store = opts.Store
+	return src
+}
+
+// verification starts as soon as the first entry of the checkset
+// arrives, rather than after all of it has been downloaded, but nothing
+// is changed until all of it has been verified and there is known to be
+// room for the update. when ctx is done, stops after rolling back the
+// file being updated and returns ctx.Err(). otherwise, if any files
+// couldn't be fixed, the error is Result.Err().
+func Update(ctx context.Context, opts Options) (Result, error) {
+	var result Result
+	opts = withDefaults(opts)
+	tracker := newTracker(opts)
+	logger := opts.Logger
+	logger.Printf("downloading checkset %s", opts.CheckSet)
+	stream, err := opts.Source.Get(ctx, opts.CheckSet)
+	if err != nil {
+		return result, err
+	}
+	defer stream.Close()
+	reader, err := checkset.NewReader(stream)
+	if err != nil {
+		return result, err
+	}
+	result.Meta = reader.Meta
+	showMeta(logger, reader.Meta)
+	err = opts.CheckMeta(reader.Meta)
+	if err != nil {
+		return result, err
+	}
+	logger.Printf("verifying files in %s", opts.Local)
+	return check(ctx, opts, reader.Send, result, tracker)
+}
+
+// try again to fix the files of an earlier Result that failed or
+// weren't attempted, checking them again first. opts should be those of
+// the earlier update.
+func Retry(ctx context.Context, opts Options, previous Result) (Result, error) {
+	result := Result { Meta: previous.Meta }
+	opts = withDefaults(opts)
+	tracker := newTracker(opts)
+	bads := previous.Failed()
+	opts.Logger.Printf("checking %d files again", len(bads))
+	send := func(ctx context.Context, entries chan checkset.Entry) error {
+		defer close(entries)
+		for _, bad := range bads {
+			select {
+			case entries <- checkset.Entry { Name: bad.Remote, Info: bad.Info }:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+	return check(ctx, opts, send, result, tracker)
+}
+
+// verify the entries send sends and closes, then fix what is bad
+func check(ctx context.Context, opts Options, send func(context.Context, chan checkset.Entry) error, result Result, tracker *checkset.Tracker) (Result, error) {
+	src := source(opts, result.Meta)
+	bads, err := newSpill()
+	if err != nil {
+		return result, err
+	}
+	defer bads.remove()
+	entries := make(chan checkset.Entry)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- send(ctx, entries)
+	}()
+	var space checkset.Space
+	found := make(chan checkset.BadFile)
+	go checkset.VerifyEntries(ctx, opts.Local, entries, found, tracker)
+	err = collectBad(ctx, opts, src, found, bads, &space, &result, tracker)
+	if serr := <-sent; serr != nil {
+		err = serr
+	}
+	if err != nil {
+		pending(opts, bads, 0, &result)
+		return result, err
+	}
+	return resolve(ctx, opts, src, bads, space, result, tracker)
+}
+
+// fix the files found bad
+func resolve(ctx context.Context, opts Options, src checkset.Source, bads *spill, space checkset.Space, result Result, tracker *checkset.Tracker) (Result, error) {
+	if opts.Size != nil {
+		err := checkSpace(opts, src, space)
+		if err != nil {
+			pending(opts, bads, 0, &result)
+			return result, err
+		}
+	}
+	if opts.Confirm != nil {
+		err := opts.Confirm(result)
+		if err != nil {
+			pending(opts, bads, 0, &result)
+			return result, err
+		}
+	}
+	todo := make(chan checkset.BadFile)
+	done := make(chan checkset.Resolution)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- bads.send(ctx, todo)
+	}()
+	go checkset.Apply(ctx, opts.Local, src, todo, done, tracker)
+	resolved := 0
+	for res := range done {
+		resolved++
+		switch {
+		case res.Err == nil:
+			result.updated++
+		case ctx.Err() != nil:
+			// rolled back, so as good as never attempted
+			result.Files = append(result.Files, FileResult { res.Bad, Pending, nil })
+		default:
+			opts.Logger.Printf("%s: %s", res.Bad.Remote, res.Err)
+			result.Files = append(result.Files, FileResult { res.Bad, Failed, res.Err })
+		}
+	}
+	// resolutions come in the order sent, so the rest were never attempted
+	err := <-sent
+	pending(opts, bads, resolved, &result)
+	if result.Found > 0 {
+		opts.Logger.Printf("updates totalled %s", FormatSize(result.Bytes))
+	}
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, result.Err()
+}
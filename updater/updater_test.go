@@ -0,0 +1,278 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/rspeele/check-update/checkset"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// updaters from before a layout refuse releases using it
+func TestRequiredVersion(t *testing.T) {
+	meta := checkset.Meta { Layout: checkset.ContentLayout }
+	meta.MinUpdater = RequiredVersion(meta, nil)
+	if meta.MinUpdater <= 1 {
+		t.Errorf("content layout requires version %d, which the first updater accepts", meta.MinUpdater)
+	}
+	if err := CheckMeta(meta); err != nil {
+		t.Errorf("this updater refuses what it requires: %v", err)
+	}
+	if RequiredVersion(checkset.Meta{}, nil) != 0 {
+		t.Error("path layout requires a version")
+	}
+	platform := func(spec string) checkset.CheckSet {
+		target, err := checkset.ParsePlatform(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return checkset.CheckSet { "a": checkset.CheckInfo { Target: target } }
+	}
+	for _, spec := range []string { "", "unix", "windows:386|amd64", "^windows:^arm" } {
+		if RequiredVersion(checkset.Meta{}, platform(spec)) != 0 {
+			t.Errorf("%q requires a version, though older updaters read it right", spec)
+		}
+	}
+	for _, spec := range []string { "linux", "darwin|windows", ":arm64", "^linux" } {
+		meta := checkset.Meta { MinUpdater: RequiredVersion(checkset.Meta{}, platform(spec)) }
+		if meta.MinUpdater <= 2 {
+			t.Errorf("%q requires version %d, which reads it as a wider platform", spec, meta.MinUpdater)
+		}
+		if err := CheckMeta(meta); err != nil {
+			t.Errorf("this updater refuses what it requires: %v", err)
+		}
+	}
+}
+
+// serves a release from memory
+type memoryServer map[string][]byte
+
+func (server memoryServer) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	data, ok := server[name]
+	if !ok {
+		return nil, errors.New("404 Not Found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (server memoryServer) release(t *testing.T, files map[string]string) {
+	cset := make(checkset.CheckSet)
+	for name, content := range files {
+		cset[name] = checkset.CheckInfo { Target: checkset.AllPlatforms, Mode: 0644,
+			Hash: checkset.HashLink(content), Size: int64(len(content)) }
+		server[name] = []byte(content)
+	}
+	var buf bytes.Buffer
+	err := checkset.Write(checkset.Meta{}, cset, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server["checkset.chk"] = buf.Bytes()
+}
+
+func testUpdate(t *testing.T, server memoryServer) Options {
+	local, err := os.MkdirTemp("", "updater")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(local) })
+	return Options {
+		Source: checkset.Source { Get: server.Get },
+		CheckSet: "checkset.chk",
+		Local: local,
+	}
+}
+
+func TestUpdateFresh(t *testing.T) {
+	server := make(memoryServer)
+	server.release(t, map[string]string { "a": "1", "b/c": "23", "d": "456" })
+	opts := testUpdate(t, server)
+	var confirmed Result
+	opts.Confirm = func(result Result) error {
+		confirmed = result
+		return nil
+	}
+	result, err := Update(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmed.Found != 3 || confirmed.Bytes != 6 {
+		t.Errorf("confirming %d files of %d bytes, want 3 of 6", confirmed.Found, confirmed.Bytes)
+	}
+	if result.Updated() != 3 || len(result.Files) != 0 {
+		t.Errorf("updated %d, left %v; want all 3 updated", result.Updated(), result.Files)
+	}
+	data, _ := os.ReadFile(filepath.Join(opts.Local, "b", "c"))
+	if string(data) != "23" {
+		t.Errorf("b/c is %q, want 23", data)
+	}
+	result, err = Update(context.Background(), opts)
+	if err != nil || result.Found != 0 {
+		t.Errorf("found %d bad files after updating, and %v", result.Found, err)
+	}
+}
+
+func TestUpdateRetry(t *testing.T) {
+	server := make(memoryServer)
+	server.release(t, map[string]string { "a": "1", "b": "2", "skip": "3" })
+	delete(server, "b")
+	opts := testUpdate(t, server)
+	opts.Filter = func(bad checkset.BadFile) bool {
+		return bad.Remote != "skip"
+	}
+	result, err := Update(context.Background(), opts)
+	if err == nil || result.Err() == nil {
+		t.Fatal("missing file didn't fail")
+	}
+	failed := result.Failed()
+	if result.Found != 2 || result.Updated() != 1 || len(failed) != 1 || failed[0].Remote != "b" {
+		t.Fatalf("found %d, updated %d, failed %v; want b to fail", result.Found, result.Updated(), failed)
+	}
+	server["b"] = []byte("2")
+	result, err = Retry(context.Background(), opts, result)
+	if err != nil || result.Updated() != 1 {
+		t.Errorf("retry updated %d, and %v", result.Updated(), err)
+	}
+	if _, err := os.Stat(filepath.Join(opts.Local, "skip")); err == nil {
+		t.Error("filtered file was installed")
+	}
+}
+
+// without room for the update, nothing is touched, not even Confirm
+func TestUpdateNoSpace(t *testing.T) {
+	server := make(memoryServer)
+	server.release(t, map[string]string { "a": "1", "b": "2" })
+	// sizes the checkset doesn't give are asked for
+	cset := checkset.CheckSet {
+		"a": { Target: checkset.AllPlatforms, Mode: 0644, Hash: checkset.HashLink("1"), Size: checkset.UnknownSize },
+		"b": { Target: checkset.AllPlatforms, Mode: 0644, Hash: checkset.HashLink("2"), Size: 1 },
+	}
+	var buf bytes.Buffer
+	if err := checkset.Write(checkset.Meta{}, cset, &buf); err != nil {
+		t.Fatal(err)
+	}
+	server["checkset.chk"] = buf.Bytes()
+	opts := testUpdate(t, server)
+	opts.Size = func(ctx context.Context, name string) (int64, error) {
+		return 1 << 60, nil
+	}
+	confirmed := false
+	opts.Confirm = func(Result) error {
+		confirmed = true
+		return nil
+	}
+	result, err := Update(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "not enough disk space") {
+		t.Fatalf("got %v, want too little disk space", err)
+	}
+	if confirmed || result.Updated() != 0 {
+		t.Errorf("went on to confirm %v and update %d files", confirmed, result.Updated())
+	}
+	entries, _ := os.ReadDir(opts.Local)
+	if len(entries) != 0 {
+		t.Errorf("wrote %d files", len(entries))
+	}
+	opts.Size = func(ctx context.Context, name string) (int64, error) {
+		return 1, nil
+	}
+	if _, err = Update(context.Background(), opts); err != nil || !confirmed {
+		t.Errorf("got %v, confirmed %v, with room for the update", err, confirmed)
+	}
+}
+
+// files left alone by Filter aren't counted as remaining or to download
+func TestUpdateProgress(t *testing.T) {
+	server := make(memoryServer)
+	server.release(t, map[string]string { "a": "1", "skip": "2345" })
+	opts := testUpdate(t, server)
+	opts.Filter = func(bad checkset.BadFile) bool {
+		return bad.Remote != "skip"
+	}
+	var last checkset.Progress
+	var lock sync.Mutex
+	opts.Progress = func(p checkset.Progress) {
+		lock.Lock()
+		defer lock.Unlock()
+		last = p
+	}
+	if _, err := Update(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if last.Checked != 2 || last.Remaining != 0 || last.Total != 1 || last.Bytes != 1 || last.ETA != 0 {
+		t.Errorf("finished with %+v", last)
+	}
+}
+
+// files not attempted because Confirm refused are all given as Pending,
+// ready to Retry
+func TestUpdateRefused(t *testing.T) {
+	server := make(memoryServer)
+	server.release(t, map[string]string { "a": "1", "b": "2" })
+	opts := testUpdate(t, server)
+	refused := errors.New("not now")
+	opts.Confirm = func(Result) error {
+		return refused
+	}
+	result, err := Update(context.Background(), opts)
+	if err != refused {
+		t.Fatalf("got %v, want Confirm's error", err)
+	}
+	if result.Found != 2 || len(result.Failed()) != 2 || result.Err() != nil {
+		t.Fatalf("found %d, left %v; want both pending", result.Found, result.Files)
+	}
+	for _, file := range result.Files {
+		if file.Status != Pending {
+			t.Errorf("%s has status %d, want Pending", file.Bad.Remote, file.Status)
+		}
+	}
+	opts.Confirm = nil
+	result, err = Retry(context.Background(), opts, result)
+	if err != nil || result.Updated() != 2 {
+		t.Errorf("retry updated %d, and %v", result.Updated(), err)
+	}
+}
+
+// cancelling part way leaves the file being fetched and the rest Pending
+func TestUpdateCancelled(t *testing.T) {
+	server := make(memoryServer)
+	server.release(t, map[string]string { "a": "1", "b": "2", "c": "3" })
+	opts := testUpdate(t, server)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts.Source.Get = func(ctx context.Context, name string) (io.ReadCloser, error) {
+		if name == "b" {
+			cancel()
+			return nil, ctx.Err()
+		}
+		return server.Get(ctx, name)
+	}
+	result, err := Update(ctx, opts)
+	if err != context.Canceled {
+		t.Fatalf("got %v, want cancelled", err)
+	}
+	if result.Found != 3 || result.Updated() + len(result.Files) != 3 || result.Err() != nil {
+		t.Fatalf("found %d, updated %d, left %v; want the rest pending", result.Found, result.Updated(), result.Files)
+	}
+	left := make(map[string]bool)
+	for _, file := range result.Files {
+		left[file.Bad.Remote] = true
+		if file.Status != Pending {
+			t.Errorf("%s has status %d, want Pending", file.Bad.Remote, file.Status)
+		}
+	}
+	if !left["b"] {
+		t.Errorf("left %v, without the file being fetched", result.Files)
+	}
+	opts.Source.Get = server.Get
+	result, err = Retry(context.Background(), opts, result)
+	if err != nil || result.Updated() != len(left) {
+		t.Errorf("retry updated %d of %d, and %v", result.Updated(), len(left), err)
+	}
+}